@@ -0,0 +1,218 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Adaptive adjusts the rate of a RateLimit per key from the feedback of the downstream it protects, using
+// additive-increase/multiplicative-decrease (AIMD): every Success() raises the rate by increase and every
+// Overloaded() multiplies it by decrease, always staying within [min, max].
+//
+// The adjusted rate of a key is stored in the backend of the RateLimit under the key suffixed with ":rate", as the
+// rate and the time of the last adjustment, so that every instance sharing the backend converges to the same rate.
+// Until a key receives feedback its rate is the one of the RateLimit (or its PolicyResolver) within [min, max]
+type Adaptive struct {
+	rl *RateLimit
+	// mu protects min, max, increase and decrease from concurrent Set calls
+	mu       *sync.RWMutex
+	min      int64
+	max      int64
+	increase int64
+	decrease float64
+}
+
+// NewAdaptive returns a new instance of Adaptive on top of rl that keeps the rate of every key within [min, max].
+// The rate increases by 1 on Success() and halves on Overloaded() until adjusted with SetIncrease() and SetDecrease()
+func NewAdaptive(rl *RateLimit, min, max int64) *Adaptive {
+	return &Adaptive{
+		rl:       rl,
+		mu:       &sync.RWMutex{},
+		min:      min,
+		max:      max,
+		increase: 1,
+		decrease: 0.5,
+	}
+}
+
+// SetBounds adjusts Adaptive.min and Adaptive.max using a RWMutex to lock the struct for safe concurrent use
+func (a *Adaptive) SetBounds(min, max int64) {
+	a.mu.Lock()
+	a.min = min
+	a.max = max
+	a.mu.Unlock()
+}
+
+// SetIncrease adjusts Adaptive.increase using a RWMutex to lock the struct for safe concurrent use
+func (a *Adaptive) SetIncrease(increase int64) {
+	a.mu.Lock()
+	a.increase = increase
+	a.mu.Unlock()
+}
+
+// SetDecrease adjusts Adaptive.decrease using a RWMutex to lock the struct for safe concurrent use, it should be
+// between 0 and 1
+func (a *Adaptive) SetDecrease(decrease float64) {
+	a.mu.Lock()
+	a.decrease = decrease
+	a.mu.Unlock()
+}
+
+// aimd is a snapshot of the Adaptive configuration
+type aimd struct {
+	min      int64
+	max      int64
+	increase int64
+	decrease float64
+}
+
+// config returns a snapshot of the Adaptive configuration taken under a read lock
+func (a *Adaptive) config() (aimd, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.min < 1 || a.max < a.min || a.increase < 0 || a.decrease <= 0 || a.decrease > 1 {
+		return aimd{}, fmt.Errorf("%w: adaptive bounds [%d, %d], increase %d and decrease %v", ErrInvalidConfig, a.min, a.max, a.increase, a.decrease)
+	}
+
+	return aimd{min: a.min, max: a.max, increase: a.increase, decrease: a.decrease}, nil
+}
+
+// clamp returns rate within [min, max]
+func (c aimd) clamp(rate int64) int64 {
+	if rate < c.min {
+		return c.min
+	}
+
+	if rate > c.max {
+		return c.max
+	}
+
+	return rate
+}
+
+// Allow is shorthand for AllowN(key, 1)
+func (a *Adaptive) Allow(key string) (Result, error) {
+	return a.AllowNContext(context.Background(), key, 1)
+}
+
+// AllowContext is shorthand for AllowNContext(ctx, key, 1)
+func (a *Adaptive) AllowContext(ctx context.Context, key string) (Result, error) {
+	return a.AllowNContext(ctx, key, 1)
+}
+
+// AllowN is shorthand for AllowNContext(context.Background(), key, n)
+func (a *Adaptive) AllowN(key string, n int64) (Result, error) {
+	return a.AllowNContext(context.Background(), key, n)
+}
+
+// AllowNContext is RateLimit.AllowNContext() with the rate adjusted for key
+func (a *Adaptive) AllowNContext(ctx context.Context, key string, n int64) (Result, error) {
+	c, err := a.config()
+	if err != nil {
+		return Result{}, err
+	}
+
+	cfg, err := a.rl.configFor(ctx, key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// keys matching an allow or deny Rule are decided without the backend so their rate is not read
+	if _, ok := cfg.matchRules(key); ok {
+		return a.rl.allowN(ctx, cfg, key, n, PriorityInteractive)
+	}
+
+	cfg.rate, err = a.rate(ctx, c, cfg, key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return a.rl.allowN(ctx, cfg, key, n, PriorityInteractive)
+}
+
+// Rate returns the rate currently applied to key
+func (a *Adaptive) Rate(key string) (int64, error) {
+	c, err := a.config()
+	if err != nil {
+		return 0, err
+	}
+
+	cfg, err := a.rl.configFor(context.Background(), key)
+	if err != nil {
+		return 0, err
+	}
+
+	return a.rate(context.Background(), c, cfg, key)
+}
+
+// Success reports that the downstream handled a request for key, raising its rate by increase up to max
+func (a *Adaptive) Success(key string) error {
+	return a.adjust(key, func(c aimd, rate int64) int64 {
+		return rate + c.increase
+	})
+}
+
+// Overloaded reports that the downstream was overloaded by a request for key, multiplying its rate by decrease
+// down to min
+func (a *Adaptive) Overloaded(key string) error {
+	return a.adjust(key, func(c aimd, rate int64) int64 {
+		return int64(float64(rate) * c.decrease)
+	})
+}
+
+// rate returns the rate stored for key within [min, max], or the rate of cfg if none is stored or it cannot be read
+// and the FailurePolicy of the RateLimit handles the failure
+func (a *Adaptive) rate(ctx context.Context, c aimd, cfg config, key string) (int64, error) {
+	var rate int64
+	failure, err := cfg.guard(ctx, "get rate", func(cfg config) (err error) {
+		rate, _, err = getState(ctx, cfg.backend, rateKey(key))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if rate == 0 || (failure != nil && cfg.failurePolicy != FailLocal) {
+		rate = cfg.rate
+	}
+
+	return c.clamp(rate), nil
+}
+
+// adjust stores the rate fn returns for the current rate of key, within [min, max]. The GetState()/SetState() round
+// trip is serialized with the key locks of the RateLimit, processes sharing a backend may occasionally overwrite
+// each other's feedback which AIMD tolerates since the rate keeps converging
+func (a *Adaptive) adjust(key string, fn func(c aimd, rate int64) int64) error {
+	c, err := a.config()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	cfg, err := a.rl.configFor(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	keyLock := a.rl.keyLocks.lock(rateKey(key))
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	rate, err := a.rate(ctx, c, cfg, key)
+	if err != nil {
+		return err
+	}
+
+	// the feedback is dropped when the FailurePolicy handles the failure
+	_, err = cfg.guard(ctx, "set rate", func(cfg config) error {
+		return setState(ctx, cfg.backend, rateKey(key), c.clamp(fn(c, rate)), cfg.clock.Now().UnixNano())
+	})
+	return err
+}
+
+// rateKey returns the key the adjusted rate of key is stored under
+func rateKey(key string) string {
+	return key + ":rate"
+}
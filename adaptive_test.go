@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+func TestAdaptiveAIMD(t *testing.T) {
+	backend := memory.New()
+	limiter, _ := newTestLimiter(backend)
+	limiter.SetRate(5)
+	adaptive := NewAdaptive(limiter, 2, 8)
+	key := "downstream"
+
+	expectRate := func(desc string, want int64) {
+		rate, err := adaptive.Rate(key)
+		if err != nil || rate != want {
+			t.Logf("rate %s %v != %v (err %v)", desc, rate, want, err)
+			t.Fail()
+		}
+	}
+
+	expectRate("before any feedback", 5)
+
+	if err := adaptive.Success(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectRate("after Success()", 6)
+
+	if err := adaptive.Overloaded(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectRate("after Overloaded()", 3)
+
+	if err := adaptive.Overloaded(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectRate("after Overloaded() below min", 2)
+
+	for i := 0; i < 10; i++ {
+		if err := adaptive.Success(key); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	expectRate("after Success() above max", 8)
+
+	// another instance sharing the backend converges to the same rate
+	other, _ := newTestLimiter(backend)
+	if rate, err := NewAdaptive(other, 2, 8).Rate(key); err != nil || rate != 8 {
+		t.Logf("rate seen by another instance %v != 8 (err %v)", rate, err)
+		t.Fail()
+	}
+
+	if _, err := NewAdaptive(limiter, 0, 8).Rate(key); !errors.Is(err, ErrInvalidConfig) {
+		t.Logf("min of 0 returned err %v", err)
+		t.Fail()
+	}
+}
+
+func TestAdaptiveAllowUsesAdjustedRate(t *testing.T) {
+	limiter, clock := newTestLimiter(memory.New())
+	adaptive := NewAdaptive(limiter, 1, defaultTestBurst)
+	key := "refill"
+
+	if _, err := adaptive.AllowN(key, defaultTestBurst); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := adaptive.Success(key); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// the rate is now 4 so an interval refills 4 tokens
+	clock.Advance(time.Second)
+	allowed := 0
+	for i := 0; i < int(defaultTestBurst); i++ {
+		if result, _ := adaptive.Allow(key); result.Allowed {
+			allowed++
+		}
+	}
+
+	if allowed != 4 {
+		t.Logf("allowed %v after one interval at rate 4", allowed)
+		t.Fail()
+	}
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+)
+
+// Deleter is an optional interface a Backend can implement to remove the state stored at a key, see
+// RateLimit.Delete()
+type Deleter interface {
+	Backend
+	// Delete removes the state stored at key, deleting a key that does not exist is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// Reset refills the bucket at key to burst, for example to lift the limit of a user who was throttled by mistake
+func (rl *RateLimit) Reset(key string) error {
+	cfg, err := rl.configFor(context.Background(), key)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	return rl.store(cfg, "reset", key, cfg.burst)
+}
+
+// SetAllowance sets the bucket at key to hold n tokens. n may be larger than burst, in which case the tokens above
+// burst can be spent but are never refilled
+func (rl *RateLimit) SetAllowance(key string, n int64) error {
+	if n < 0 {
+		return fmt.Errorf("failed to set allowance: n must not be negative, got %d", n)
+	}
+
+	cfg, err := rl.configFor(context.Background(), key)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	return rl.store(cfg, "set allowance", key, n)
+}
+
+// Credit adds n tokens to the bucket at key after refilling it, without filling it beyond burst. It is the same
+// operation Reservation.Cancel() uses to return tokens
+func (rl *RateLimit) Credit(key string, n int64) error {
+	if n < 1 {
+		return fmt.Errorf("failed to credit: n must be positive, got %d", n)
+	}
+
+	cfg, err := rl.configFor(context.Background(), key)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	return cfg.call(ctx, "credit", func(cfg config) error {
+		_, _, _, err := take(ctx, rl.keyLocks, cfg, key, -n, 0, cfg.clock.Now().UnixNano())
+		return err
+	})
+}
+
+// Delete removes the state stored at key so that it is treated like a key that has never been seen, that is with
+// a full bucket. Backends that don't implement Deleter have the zero state stored at key instead, which Allow()
+// treats the same way
+func (rl *RateLimit) Delete(key string) error {
+	cfg := rl.config()
+
+	keyLock := rl.keyLocks.lock(key)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	ctx := context.Background()
+	return cfg.call(ctx, "delete", func(cfg config) error {
+		if deleter, ok := cfg.backend.(Deleter); ok {
+			return deleter.Delete(ctx, key)
+		}
+
+		return setState(ctx, cfg.backend, key, 0, 0)
+	})
+}
+
+// store overwrites the state at key with allowance tokens as of now. The key lock is held so that the write
+// cannot interleave with the GetState()/SetState() round trip of a concurrent Allow()
+func (rl *RateLimit) store(cfg config, op string, key string, allowance int64) error {
+	keyLock := rl.keyLocks.lock(key)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	ctx := context.Background()
+	return cfg.call(ctx, op, func(cfg config) error {
+		return setState(ctx, cfg.backend, key, allowance, cfg.clock.Now().UnixNano())
+	})
+}
@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"testing"
+)
+
+func TestAdminOperations(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, _ := newTestLimiter(backend)
+		key := "admin"
+
+		if _, err := limiter.AllowN(key, defaultTestBurst); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := limiter.Reset(key); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, _ := limiter.Status(key); status.Allowance != defaultTestBurst {
+			t.Logf("(%s) allowance after Reset() %v != %v", name, status.Allowance, defaultTestBurst)
+			t.Fail()
+		}
+
+		if err := limiter.SetAllowance(key, 2); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, _ := limiter.Status(key); status.Allowance != 2 {
+			t.Logf("(%s) allowance after SetAllowance(2) %v != 2", name, status.Allowance)
+			t.Fail()
+		}
+
+		if err := limiter.Credit(key, 3); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, _ := limiter.Status(key); status.Allowance != 5 {
+			t.Logf("(%s) allowance after Credit(3) %v != 5", name, status.Allowance)
+			t.Fail()
+		}
+
+		// credit never fills the bucket beyond burst
+		if err := limiter.Credit(key, defaultTestBurst); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, _ := limiter.Status(key); status.Allowance != defaultTestBurst {
+			t.Logf("(%s) allowance after Credit(burst) %v != %v", name, status.Allowance, defaultTestBurst)
+			t.Fail()
+		}
+
+		if err := limiter.SetAllowance(key, 0); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := limiter.Delete(key); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// a deleted key is treated like a key that has never been seen
+		if result, _ := limiter.Allow(key); !result.Allowed || result.Remaining != defaultTestBurst-1 {
+			t.Logf("(%s) Allow() after Delete() returned %+v", name, result)
+			t.Fail()
+		}
+
+		if err := limiter.SetAllowance(key, -1); err == nil {
+			t.Logf("(%s) SetAllowance(-1) returned no error", name)
+			t.Fail()
+		}
+
+		if err := limiter.Credit(key, 0); err == nil {
+			t.Logf("(%s) Credit(0) returned no error", name)
+			t.Fail()
+		}
+	}
+}
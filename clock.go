@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock is an abstraction over time so that buckets can be refilled deterministically in tests, see
+// ratelimittest.Clock for a manually advanced implementation
+type Clock interface {
+	// Now returns the current time, the bucket timestamps stored in a Backend are Now().UnixNano()
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time on the returned channel, like time.After()
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the default Clock. Now() never returns a time before a previously returned time, so a wall clock
+// stepped backwards (i.e. by NTP) pauses refilling instead of handing out timestamps older than those already stored
+type systemClock struct {
+	// latestNS is the latest time returned by Now() in nanoseconds since the unix epoch
+	latestNS int64
+}
+
+// newSystemClock returns a new instance of systemClock
+func newSystemClock() *systemClock {
+	return &systemClock{}
+}
+
+// Now returns time.Now(), or the latest time previously returned if the wall clock has moved backwards
+func (c *systemClock) Now() time.Time {
+	for {
+		now := time.Now()
+		latestNS := atomic.LoadInt64(&c.latestNS)
+		if now.UnixNano() <= latestNS {
+			return time.Unix(0, latestNS)
+		}
+
+		if atomic.CompareAndSwapInt64(&c.latestNS, latestNS, now.UnixNano()) {
+			return now
+		}
+	}
+}
+
+// After is time.After()
+func (c *systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,23 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSystemClockNeverMovesBackwards(t *testing.T) {
+	clock := newSystemClock()
+	first := clock.Now()
+	if second := clock.Now(); second.Before(first) {
+		t.Logf("Now() %v is before a previous Now() %v", second, first)
+		t.Fail()
+	}
+
+	// a time returned before the wall clock was stepped backwards
+	future := time.Now().Add(time.Hour).UnixNano()
+	clock.latestNS = future
+	if got := clock.Now().UnixNano(); got != future {
+		t.Logf("Now() %v after the wall clock moved backwards != %v", got, future)
+		t.Fail()
+	}
+}
@@ -0,0 +1,229 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Composite enforces several Limits on the same key, for example 10 per second and 1000 per hour and 20000 per
+// day. A request is only admitted when every window has capacity and no window is charged when another one
+// rejects, which several RateLimit instances with separate Allow() calls cannot guarantee.
+//
+// The state of each window is stored under the key suffixed with the index of its Limit (i.e. "benjamin:0",
+// "benjamin:1") and all of them are evaluated and committed together, in a single script if the backend
+// implements MultiBackend, under the backend locks if it implements UpdateBackend, or else under the striped
+// key locks of the Composite. Note that on a redis cluster the window keys of a key must hash to the same slot
+type Composite struct {
+	// mu protects limits, backend and clock from concurrent Set calls
+	mu      *sync.RWMutex
+	limits  []Limit
+	backend Backend
+	clock   Clock
+	// keyLocks serializes the GetState()/SetState() round trips of the windows of a key
+	keyLocks stripedMutex
+}
+
+// NewComposite returns a new instance of Composite enforcing every one of limits
+func NewComposite(backend Backend, limits ...Limit) *Composite {
+	return &Composite{
+		mu:       &sync.RWMutex{},
+		limits:   limits,
+		backend:  backend,
+		clock:    newSystemClock(),
+		keyLocks: newStripedMutex(defaultLockStripes),
+	}
+}
+
+// SetLimits adjusts Composite.limits using a RWMutex to lock the struct for safe concurrent use. Windows are
+// matched to stored state by index so reordering limits mixes up their state
+func (c *Composite) SetLimits(limits ...Limit) {
+	c.mu.Lock()
+	c.limits = limits
+	c.mu.Unlock()
+}
+
+// SetBackend adjusts Composite.backend using a RWMutex to lock the struct for safe concurrent use
+func (c *Composite) SetBackend(backend Backend) {
+	c.mu.Lock()
+	c.backend = backend
+	c.mu.Unlock()
+}
+
+// SetClock adjusts Composite.clock using a RWMutex to lock the struct for safe concurrent use
+func (c *Composite) SetClock(clock Clock) {
+	c.mu.Lock()
+	c.clock = clock
+	c.mu.Unlock()
+}
+
+// Allow is shorthand for AllowN(key, 1)
+func (c *Composite) Allow(key string) (Result, error) {
+	return c.AllowNContext(context.Background(), key, 1)
+}
+
+// AllowContext is shorthand for AllowNContext(ctx, key, 1)
+func (c *Composite) AllowContext(ctx context.Context, key string) (Result, error) {
+	return c.AllowNContext(ctx, key, 1)
+}
+
+// AllowN is shorthand for AllowNContext(context.Background(), key, n)
+func (c *Composite) AllowN(key string, n int64) (Result, error) {
+	return c.AllowNContext(context.Background(), key, n)
+}
+
+// AllowNContext spends n tokens from every window of key, or from none of them if any window lacks n tokens. The Result
+// describes the most constrained window: Limit and Remaining come from the window with the fewest tokens left while
+// RetryAfter and ResetAfter are the longest of any window. ctx is passed to the backend like in
+// RateLimit.AllowNContext()
+func (c *Composite) AllowNContext(ctx context.Context, key string, n int64) (Result, error) {
+	c.mu.RLock()
+	limits := c.limits
+	backend := c.backend
+	clock := c.clock
+	c.mu.RUnlock()
+
+	if len(limits) == 0 {
+		return Result{}, fmt.Errorf("%w: composite has no limits", ErrInvalidConfig)
+	}
+
+	if n < 1 {
+		return Result{}, fmt.Errorf("failed to allowN: n must be positive, got %d", n)
+	}
+
+	keys := make([]string, len(limits))
+	cfgs := make([]config, len(limits))
+	for i, limit := range limits {
+		keys[i] = windowKey(key, i)
+		cfgs[i] = config{backend: backend}.withLimit(limit)
+		if err := cfgs[i].validate(); err != nil {
+			return Result{}, fmt.Errorf("window %d: %w", i, err)
+		}
+
+		if n > cfgs[i].burst {
+			return Result{}, fmt.Errorf("failed to allowN: %w (%d > %d in window %d)", ErrExceedsBurst, n, cfgs[i].burst, i)
+		}
+	}
+
+	currentTime := clock.Now().UnixNano()
+	windows, allowances, lastAccessedTimestampsNS, err := takeAll(ctx, backend, c.keyLocks, keys, cfgs, n, true, currentTime)
+	if err != nil {
+		return Result{}, wrapBackendError("allowN", err)
+	}
+
+	allowed := true
+	for _, ok := range windows {
+		allowed = allowed && ok
+	}
+
+	var result Result
+	for i, cfg := range cfgs {
+		window := newResult(cfg, currentTime, allowed, allowances[i], lastAccessedTimestampsNS[i], n, 0)
+		if i == 0 || window.Remaining < result.Remaining {
+			result.Limit = window.Limit
+			result.Remaining = window.Remaining
+		}
+
+		if window.RetryAfter > result.RetryAfter {
+			result.RetryAfter = window.RetryAfter
+		}
+
+		if window.ResetAfter > result.ResetAfter {
+			result.ResetAfter = window.ResetAfter
+		}
+	}
+	result.Allowed = allowed
+
+	return result, nil
+}
+
+// windowKey returns the key the state of window i of key is stored under
+func windowKey(key string, i int) string {
+	return key + ":" + strconv.Itoa(i)
+}
+
+// takeAll refills the bucket at every key with the config at the same index and spends cost tokens from each bucket
+// that has enough. If atomic is true tokens are spent from all of them or from none of them, and when nothing is
+// spent the refilled allowances are returned but not stored. allowed reports whether each bucket had enough tokens.
+// backend and keyLocks are shared by every key
+func takeAll(ctx context.Context, backend Backend, keyLocks stripedMutex, keys []string, cfgs []config, cost int64, atomic bool, currentTime int64) (allowed []bool, allowances, lastAccessedTimestampsNS []int64, err error) {
+	if multiBackend, ok := backend.(MultiBackend); ok {
+		limits := make([]Limit, len(cfgs))
+		for i, cfg := range cfgs {
+			limits[i] = cfg.limit()
+		}
+
+		return multiBackend.TakeAll(ctx, keys, cost, limits, atomic, currentTime)
+	}
+
+	allowed = make([]bool, len(keys))
+
+	// apply refills every bucket and spends cost tokens from the buckets that have enough, or from none of them if
+	// atomic and any bucket lacks them. It returns whether the state should be stored
+	apply := func(allowances, lastAccessedTimestampsNS []int64) bool {
+		spent := make([]int64, len(keys))
+		all := true
+		for i, cfg := range cfgs {
+			allowances[i], lastAccessedTimestampsNS[i] = refillAllowance(
+				currentTime,
+				allowances[i],
+				lastAccessedTimestampsNS[i],
+				cfg.burst,
+				int64(cfg.interval),
+				cfg.rate,
+			)
+
+			spent[i] = allowances[i]
+			if allowed[i] = allowances[i]-cost >= 0; allowed[i] {
+				spent[i] -= cost
+			} else {
+				all = false
+			}
+		}
+
+		if atomic && !all {
+			return false
+		}
+
+		copy(allowances, spent)
+		return true
+	}
+
+	if updateBackend, ok := backend.(UpdateBackend); ok {
+		err := updateBackend.Update(keys, func(a, l []int64) bool {
+			store := apply(a, l)
+			allowances, lastAccessedTimestampsNS = append([]int64(nil), a...), append([]int64(nil), l...)
+			return store
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		return allowed, allowances, lastAccessedTimestampsNS, nil
+	}
+
+	unlock := keyLocks.lockAll(keys)
+	defer unlock()
+
+	allowances = make([]int64, len(keys))
+	lastAccessedTimestampsNS = make([]int64, len(keys))
+	for i, key := range keys {
+		allowances[i], lastAccessedTimestampsNS[i], err = getState(ctx, backend, key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if !apply(allowances, lastAccessedTimestampsNS) {
+		return allowed, allowances, lastAccessedTimestampsNS, nil
+	}
+
+	for i, key := range keys {
+		if err := setState(ctx, backend, key, allowances[i], lastAccessedTimestampsNS[i]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return allowed, allowances, lastAccessedTimestampsNS, nil
+}
@@ -0,0 +1,188 @@
+package ratelimit
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+// plainBackend hides the optional interfaces of a Backend so the GetState()/SetState() code paths are tested
+type plainBackend struct {
+	backend Backend
+}
+
+func (b *plainBackend) GetState(key string) (int64, int64, error) {
+	return b.backend.GetState(key)
+}
+
+func (b *plainBackend) SetState(key string, allowance int64, lastAccessedTimestampNS int64) error {
+	return b.backend.SetState(key, allowance, lastAccessedTimestampNS)
+}
+
+// multiBackend implements MultiBackend over the GetState()/SetState() of backend the way the redis scripts do, and
+// records the arguments of its last TakeAll() call
+type multiBackend struct {
+	backend Backend
+	mu      sync.Mutex
+	calls   int
+	keys    []string
+	cost    int64
+	limits  []Limit
+	atomic  bool
+}
+
+func (b *multiBackend) GetState(key string) (int64, int64, error) {
+	return b.backend.GetState(key)
+}
+
+func (b *multiBackend) SetState(key string, allowance int64, lastAccessedTimestampNS int64) error {
+	return b.backend.SetState(key, allowance, lastAccessedTimestampNS)
+}
+
+func (b *multiBackend) TakeAll(ctx context.Context, keys []string, cost int64, limits []Limit, atomic bool, now int64) ([]bool, []int64, []int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls++
+	b.keys, b.cost, b.limits, b.atomic = keys, cost, limits, atomic
+	allowed := make([]bool, len(keys))
+	allowances := make([]int64, len(keys))
+	lastAccessedTimestampsNS := make([]int64, len(keys))
+	all := true
+	for i, key := range keys {
+		allowance, lastAccessedTimestampNS, err := b.backend.GetState(key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		allowances[i], lastAccessedTimestampsNS[i] = refillAllowance(now, allowance, lastAccessedTimestampNS, limits[i].Burst, int64(limits[i].Interval), limits[i].Rate)
+		allowed[i] = allowances[i]-cost >= 0
+		all = all && allowed[i]
+	}
+
+	if atomic && !all {
+		return allowed, allowances, lastAccessedTimestampsNS, nil
+	}
+
+	for i, key := range keys {
+		if allowed[i] {
+			allowances[i] -= cost
+		}
+
+		if err := b.backend.SetState(key, allowances[i], lastAccessedTimestampsNS[i]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return allowed, allowances, lastAccessedTimestampsNS, nil
+}
+
+func TestCompositeDoesNotChargeOnPartialFailure(t *testing.T) {
+	backends := map[string]Backend{
+		"update": memory.New(),
+		"plain":  &plainBackend{memory.New()},
+		"multi":  &multiBackend{backend: memory.New()},
+	}
+
+	for name, backend := range backends {
+		perSecond := Limit{Rate: 1, Interval: time.Second, Burst: 3}
+		perHour := Limit{Rate: 5, Interval: time.Hour, Burst: 5}
+		composite := NewComposite(backend, perSecond, perHour)
+		key := "composite"
+
+		for i := 0; i < 3; i++ {
+			result, err := composite.Allow(key)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if !result.Allowed {
+				t.Logf("(backend %s) Allow #%v was not allowed", name, i)
+				t.Fail()
+			}
+		}
+
+		// the per second window is empty so the per hour window must not be charged
+		result, err := composite.Allow(key)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if result.Allowed || result.Remaining != 0 || result.Limit != perSecond.Burst || result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+			t.Logf("(backend %s) Allow on an empty window returned %+v", name, result)
+			t.Fail()
+		}
+
+		allowance, _, err := backend.GetState(windowKey(key, 1))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if allowance != 2 {
+			t.Logf("(backend %s) per hour window allowance %v != 2", name, allowance)
+			t.Fail()
+		}
+
+		// ResetAfter is driven by the slowest window to refill
+		if result.ResetAfter <= 2*time.Hour/5 {
+			t.Logf("(backend %s) Result.ResetAfter %v does not account for the per hour window", name, result.ResetAfter)
+			t.Fail()
+		}
+	}
+}
+
+func TestMultiBackendTakeAll(t *testing.T) {
+	backend := &multiBackend{backend: memory.New()}
+	perSecond := Limit{Rate: 1, Interval: time.Second, Burst: 3}
+	perHour := Limit{Rate: 5, Interval: time.Hour, Burst: 5}
+	composite := NewComposite(backend, perSecond, perHour)
+
+	if result, err := composite.AllowN("composite:multi", 2); err != nil || !result.Allowed || result.Remaining != 1 {
+		t.Logf("Composite.AllowN() returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	wantKeys := []string{windowKey("composite:multi", 0), windowKey("composite:multi", 1)}
+	if backend.calls != 1 || !reflect.DeepEqual(backend.keys, wantKeys) || backend.cost != 2 || !backend.atomic ||
+		!reflect.DeepEqual(backend.limits, []Limit{perSecond, perHour}) {
+		t.Logf("Composite.AllowN() called TakeAll() %d times with keys %v cost %d limits %v atomic %v", backend.calls, backend.keys, backend.cost, backend.limits, backend.atomic)
+		t.Fail()
+	}
+
+	// the Limit of every key is resolved separately and passed at the index of its key
+	limiter, _ := newTestLimiter(backend)
+	premium := Limit{Rate: 10, Interval: time.Minute, Burst: 100}
+	limiter.SetPolicyResolver(PolicyResolverFunc(func(ctx context.Context, key string) (Limit, error) {
+		if strings.HasPrefix(key, "multi:premium") {
+			return premium, nil
+		}
+
+		return Limit{}, ErrNoPolicy
+	}))
+
+	defaults := Limit{Rate: defaultTestRate, Interval: defaultTestInterval, Burst: defaultTestBurst}
+	for _, atomic := range []bool{false, true} {
+		keys := []string{"multi:free:" + strconv.FormatBool(atomic), "multi:premium:" + strconv.FormatBool(atomic)}
+		allow := limiter.AllowMulti
+		if atomic {
+			allow = limiter.AllowAll
+		}
+
+		if results, err := allow(keys); err != nil || !results[0].Allowed || results[1].Remaining != premium.Burst-1 {
+			t.Logf("(atomic %v) returned %+v err %v", atomic, results, err)
+			t.Fail()
+		}
+
+		if !reflect.DeepEqual(backend.keys, keys) || backend.cost != 1 || backend.atomic != atomic ||
+			!reflect.DeepEqual(backend.limits, []Limit{defaults, premium}) {
+			t.Logf("(atomic %v) TakeAll() was called with keys %v cost %d limits %v atomic %v", atomic, backend.keys, backend.cost, backend.limits, backend.atomic)
+			t.Fail()
+		}
+	}
+}
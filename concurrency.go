@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LeaseBackend is a Backend that can store the leases of a Concurrency limiter. Every lease expires on its own so
+// that a process crashing while holding one cannot leak the slot
+type LeaseBackend interface {
+	Backend
+	// AcquireLease removes the leases of key that expired at or before now (in nanoseconds) and adds the lease id
+	// expiring at expires (in nanoseconds) if fewer than limit leases are left. It returns whether the lease was
+	// added and the number of leases held after the call
+	AcquireLease(ctx context.Context, key, id string, limit, expires, now int64) (acquired bool, held int64, err error)
+	// ReleaseLease removes the lease id of key, releasing a lease that does not exist is not an error
+	ReleaseLease(ctx context.Context, key, id string) error
+}
+
+// Concurrency caps the work in flight per key, for example at most 5 simultaneous report exports per tenant, where
+// RateLimit caps how often work may start
+type Concurrency struct {
+	// mu protects limit, ttl, backend and clock from concurrent Set calls
+	mu      *sync.RWMutex
+	limit   int64
+	ttl     time.Duration
+	backend LeaseBackend
+	clock   Clock
+}
+
+// NewConcurrency returns a new instance of Concurrency allowing limit leases per key, each expiring after ttl unless
+// it is released before
+func NewConcurrency(limit int64, ttl time.Duration, backend LeaseBackend) *Concurrency {
+	return &Concurrency{
+		mu:      &sync.RWMutex{},
+		limit:   limit,
+		ttl:     ttl,
+		backend: backend,
+		clock:   newSystemClock(),
+	}
+}
+
+// SetLimit adjusts Concurrency.limit using a RWMutex to lock the struct for safe concurrent use
+func (c *Concurrency) SetLimit(limit int64) {
+	c.mu.Lock()
+	c.limit = limit
+	c.mu.Unlock()
+}
+
+// SetTTL adjusts Concurrency.ttl using a RWMutex to lock the struct for safe concurrent use, it applies to the
+// leases acquired afterwards
+func (c *Concurrency) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	c.ttl = ttl
+	c.mu.Unlock()
+}
+
+// SetBackend adjusts Concurrency.backend using a RWMutex to lock the struct for safe concurrent use
+func (c *Concurrency) SetBackend(backend LeaseBackend) {
+	c.mu.Lock()
+	c.backend = backend
+	c.mu.Unlock()
+}
+
+// SetClock adjusts Concurrency.clock using a RWMutex to lock the struct for safe concurrent use
+func (c *Concurrency) SetClock(clock Clock) {
+	c.mu.Lock()
+	c.clock = clock
+	c.mu.Unlock()
+}
+
+// Lease is a slot of a Concurrency limiter held until it is released or expires
+type Lease struct {
+	backend   LeaseBackend
+	key       string
+	id        string
+	expiresAt time.Time
+}
+
+// Acquire is shorthand for AcquireContext(context.Background(), key)
+func (c *Concurrency) Acquire(key string) (Lease, error) {
+	return c.AcquireContext(context.Background(), key)
+}
+
+// AcquireContext takes a lease for key, or returns an error wrapping ErrLeaseUnavailable if key already holds limit
+// unexpired leases. The lease must be released with Lease.Release() once the work is done
+func (c *Concurrency) AcquireContext(ctx context.Context, key string) (Lease, error) {
+	c.mu.RLock()
+	limit := c.limit
+	ttl := c.ttl
+	backend := c.backend
+	clock := c.clock
+	c.mu.RUnlock()
+
+	if limit < 1 || ttl <= 0 {
+		return Lease{}, fmt.Errorf("%w: concurrency limit %d and ttl %v must be positive", ErrInvalidConfig, limit, ttl)
+	}
+
+	id, err := newLeaseID()
+	if err != nil {
+		return Lease{}, fmt.Errorf("failed to acquire: %w", err)
+	}
+
+	now := clock.Now()
+	expiresAt := now.Add(ttl)
+	acquired, held, err := backend.AcquireLease(ctx, key, id, limit, expiresAt.UnixNano(), now.UnixNano())
+	if err != nil {
+		return Lease{}, wrapBackendError("acquire", err)
+	}
+
+	if !acquired {
+		return Lease{}, fmt.Errorf("failed to acquire: %w (%d of %d held)", ErrLeaseUnavailable, held, limit)
+	}
+
+	return Lease{backend: backend, key: key, id: id, expiresAt: expiresAt}, nil
+}
+
+// ExpiresAt returns the time at which the lease is released if Release() is not called before
+func (l Lease) ExpiresAt() time.Time {
+	return l.expiresAt
+}
+
+// Release is shorthand for ReleaseContext(context.Background())
+func (l Lease) Release() error {
+	return l.ReleaseContext(context.Background())
+}
+
+// ReleaseContext gives the slot of the lease back so another caller can acquire it. Releasing a lease that has
+// already been released or has expired is a no-op
+func (l Lease) ReleaseContext(ctx context.Context) error {
+	if l.backend == nil {
+		return nil
+	}
+
+	return wrapBackendError("release", l.backend.ReleaseLease(ctx, l.key, l.id))
+}
+
+// newLeaseID returns a random identifier for a lease
+func newLeaseID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
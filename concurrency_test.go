@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+	"github.com/beeekind/ratelimit/ratelimittest"
+)
+
+func TestConcurrencyLeases(t *testing.T) {
+	clock := ratelimittest.NewClock(tNow)
+	concurrency := NewConcurrency(2, time.Minute, memory.New())
+	concurrency.SetClock(clock)
+	key := "exports"
+
+	first, err := concurrency.Acquire(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !first.ExpiresAt().Equal(tNow.Add(time.Minute)) {
+		t.Logf("ExpiresAt() %v != %v", first.ExpiresAt(), tNow.Add(time.Minute))
+		t.Fail()
+	}
+
+	if _, err := concurrency.Acquire(key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := concurrency.Acquire(key); !errors.Is(err, ErrLeaseUnavailable) {
+		t.Logf("Acquire() beyond the limit returned err %v", err)
+		t.Fail()
+	}
+
+	// other keys have their own leases
+	if _, err := concurrency.Acquire("other"); err != nil {
+		t.Logf("Acquire() of another key returned err %v", err)
+		t.Fail()
+	}
+
+	// releasing a lease frees its slot, releasing it twice is a no-op
+	for i := 0; i < 2; i++ {
+		if err := first.Release(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if _, err := concurrency.Acquire(key); err != nil {
+		t.Logf("Acquire() after Release() returned err %v", err)
+		t.Fail()
+	}
+
+	if _, err := concurrency.Acquire(key); !errors.Is(err, ErrLeaseUnavailable) {
+		t.Logf("Acquire() beyond the limit after Release() returned err %v", err)
+		t.Fail()
+	}
+
+	// leases that are never released expire after the ttl
+	clock.Advance(time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := concurrency.Acquire(key); err != nil {
+			t.Logf("Acquire() #%v after the leases expired returned err %v", i, err)
+			t.Fail()
+		}
+	}
+
+	if _, err := NewConcurrency(0, time.Minute, memory.New()).Acquire(key); !errors.Is(err, ErrInvalidConfig) {
+		t.Logf("a limit of 0 returned err %v", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrBackendUnavailable is wrapped around any error returned by a Backend that does not already wrap
+	// ErrCorruptState, for example a connection failure or timeout
+	ErrBackendUnavailable = errors.New("ratelimit: backend unavailable")
+	// ErrCorruptState is wrapped by backends when the state stored at a key cannot be parsed
+	ErrCorruptState = errors.New("ratelimit: corrupt state")
+	// ErrInvalidConfig is returned when the rate, interval or burst of a RateLimit can never allow a request
+	ErrInvalidConfig = errors.New("ratelimit: invalid config")
+	// ErrExceedsBurst is returned by AllowN() when n is larger than RateLimit.burst, such a request could never be allowed
+	ErrExceedsBurst = errors.New("ratelimit: n exceeds burst")
+	// ErrWaitExceedsDeadline is returned by Wait() and WaitN() when the context deadline would pass before the
+	// requested tokens are available, so the caller doesn't sleep only to time out
+	ErrWaitExceedsDeadline = errors.New("ratelimit: wait exceeds context deadline")
+	// ErrDenied is returned by Wait() and WaitN() when the key matches a deny Rule, the Rule is included in the
+	// message. Waiting never lifts a deny Rule so it is returned without sleeping
+	ErrDenied = errors.New("ratelimit: denied by rule")
+	// ErrQueueFull is returned by Wait() and WaitN() when RateLimit.maxWaiters goroutines are already waiting on the key
+	ErrQueueFull = errors.New("ratelimit: wait queue full")
+	// ErrLeaseUnavailable is returned by Concurrency.Acquire() when the key already holds as many leases as allowed
+	ErrLeaseUnavailable = errors.New("ratelimit: lease unavailable")
+	// ErrCircuitOpen is wrapped with ErrBackendUnavailable when the circuit breaker of a RateLimit is open and the
+	// backend was not called, see RateLimit.SetCircuitBreaker()
+	ErrCircuitOpen = errors.New("ratelimit: circuit breaker open")
+)
+
+// backendError wraps an error returned by a Backend so that errors.Is(err, ErrBackendUnavailable) holds while
+// the original error remains available to errors.Is() and errors.As() through Unwrap()
+type backendError struct {
+	op  string
+	err error
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("failed to %s: %s: %s", e.op, ErrBackendUnavailable.Error(), e.err.Error())
+}
+
+func (e *backendError) Unwrap() error {
+	return e.err
+}
+
+func (e *backendError) Is(target error) bool {
+	return target == ErrBackendUnavailable
+}
+
+// wrapBackendError classifies an error returned by a Backend, errors that already wrap ErrCorruptState
+// are only annotated with op while everything else is wrapped as ErrBackendUnavailable
+func wrapBackendError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, ErrCorruptState) {
+		return fmt.Errorf("failed to %s: %w", op, err)
+	}
+
+	return &backendError{op: op, err: err}
+}
@@ -30,19 +30,19 @@ func main() {
 	successes := 0
 	failures := 0
 	for i := 0; i < 15; i++ {
-		wait, err := limiter.Allow("benjamin")
+		result, err := limiter.Allow("benjamin")
 		if err != nil {
 			println(err.Error())
 			return
 		}
 
-		if wait == 0 {
+		if result.Allowed {
 			successes++
 			continue
 		}
 
 		failures++
-		time.Sleep(wait)
+		time.Sleep(result.RetryAfter)
 	}
 
 	fmt.Printf("successes: %v\n", successes)
@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FailurePolicy decides requests when the backend of a RateLimit is unavailable, see RateLimit.SetFailurePolicy()
+type FailurePolicy int
+
+const (
+	// FailError returns the error of the backend to the caller, it is the default
+	FailError FailurePolicy = iota
+	// FailOpen admits every request while the backend is unavailable
+	FailOpen
+	// FailClosed rejects every request while the backend is unavailable
+	FailClosed
+	// FailLocal limits requests with a memory.Backend local to the process while the backend is unavailable, with
+	// the same limits. Every process sharing the backend then enforces the limit on its own
+	FailLocal
+)
+
+// String implements fmt.Stringer
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailError:
+		return "error"
+	case FailOpen:
+		return "open"
+	case FailClosed:
+		return "closed"
+	case FailLocal:
+		return "local"
+	default:
+		return fmt.Sprintf("FailurePolicy(%d)", int(p))
+	}
+}
+
+// SetFailurePolicy adjusts RateLimit.failurePolicy using a RWMutex to lock the struct for safe concurrent use.
+// Unless the policy is FailError, Allow(), AllowN(), AllowMulti(), Overdraft() and the methods built on them,
+// including those of Penalty and Adaptive, return no error when the backend is unavailable and the Result is decided
+// by the policy with Result.Degraded set. Penalties and adjusted rates that cannot be read are ignored. Errors
+// wrapping ErrCorruptState, and requests whose context is done, are still returned.
+//
+// Status(), Reset(), SetAllowance(), Credit(), Delete(), Reservation.Cancel() and Overdraft.Settle() are not decided
+// by the policy, they return the error of the backend. They do go through the circuit breaker, so while it is open
+// they fail with an error wrapping ErrCircuitOpen without calling the backend
+func (rl *RateLimit) SetFailurePolicy(policy FailurePolicy) {
+	rl.mu.Lock()
+	rl.failurePolicy = policy
+	rl.mu.Unlock()
+}
+
+// SetCircuitBreaker adjusts RateLimit.breaker using a RWMutex to lock the struct for safe concurrent use. After
+// threshold consecutive failures of the backend the circuit opens and the backend is not called for cooldown, the
+// requests are decided by the FailurePolicy with an error wrapping ErrCircuitOpen instead. Once cooldown has passed
+// a single request probes the backend, closing the circuit if it succeeds or opening it for another cooldown if it
+// fails. A threshold < 1 disables the circuit breaker
+func (rl *RateLimit) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	rl.mu.Lock()
+	rl.breaker = newCircuitBreaker(threshold, cooldown)
+	rl.mu.Unlock()
+}
+
+// circuitBreaker counts the consecutive failures of a backend and stops calling it while it is open. A nil
+// circuitBreaker is always closed
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	// mu protects failures, openedAt and probing
+	mu       *sync.Mutex
+	failures int
+	// openedAt is when the circuit last opened, the zero time.Time while it is closed
+	openedAt time.Time
+	// probing is true while a request is probing the backend of an open circuit
+	probing bool
+}
+
+// newCircuitBreaker returns a new instance of circuitBreaker, or nil if threshold < 1
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold < 1 {
+		return nil
+	}
+
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		mu:        &sync.Mutex{},
+	}
+}
+
+// allow reports whether the backend can be called at now, that is when the circuit is closed or when it is open
+// and the cooldown has passed without another request probing the backend
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return true
+	}
+
+	if b.probing || now.Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// record counts the outcome of a call to the backend made at now
+func (b *circuitBreaker) record(now time.Time, failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.openedAt = now
+		b.probing = false
+	}
+}
+
+// cancel gives up a probe whose outcome is unknown so that the next request probes the backend again
+func (b *circuitBreaker) cancel() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// reset closes the circuit
+func (b *circuitBreaker) reset() {
+	b.record(time.Time{}, false)
+}
+
+// call calls fn with cfg through the circuit breaker of cfg and returns its error wrapped with op, or an error
+// wrapping ErrCircuitOpen without calling fn while the circuit is open. The FailurePolicy is not applied
+func (c config) call(ctx context.Context, op string, fn func(cfg config) error) error {
+	now := c.clock.Now()
+	if !c.breaker.allow(now) {
+		return wrapBackendError(op, ErrCircuitOpen)
+	}
+
+	err := wrapBackendError(op, fn(c))
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up, which says nothing about the health of the backend
+		c.breaker.cancel()
+	} else {
+		// a corrupt key was still read from a healthy backend
+		c.breaker.record(now, err != nil && !errors.Is(err, ErrCorruptState))
+	}
+
+	return err
+}
+
+// guard calls fn with cfg with call(). When the backend is unavailable, or the circuit is open, the failure is
+// returned for the FailurePolicy to handle and with FailLocal fn is called again with the local backend of cfg. err
+// is only set for errors the FailurePolicy does not handle
+func (c config) guard(ctx context.Context, op string, fn func(cfg config) error) (failure error, err error) {
+	failure = c.call(ctx, op, fn)
+	if failure == nil {
+		return nil, nil
+	}
+
+	if c.failurePolicy == FailError || errors.Is(failure, ErrCorruptState) || ctx.Err() != nil {
+		return nil, failure
+	}
+
+	if c.failurePolicy == FailLocal {
+		local := c
+		local.backend = c.local
+		if err := fn(local); err != nil {
+			return nil, wrapBackendError(op, err)
+		}
+	}
+
+	return failure, nil
+}
+
+// failedResult returns the Result of a request decided by FailOpen or FailClosed
+func (c config) failedResult() Result {
+	if c.failurePolicy == FailOpen {
+		return Result{Allowed: true, Limit: c.burst, Remaining: c.burst, Degraded: true}
+	}
+
+	return c.admit(Result{Allowed: false, Limit: c.burst, RetryAfter: c.interval, Degraded: true})
+}
@@ -0,0 +1,327 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+// flakyBackend fails every call while it is down and counts the calls it receives
+type flakyBackend struct {
+	backend Backend
+	mu      sync.Mutex
+	down    bool
+	calls   int
+}
+
+func (b *flakyBackend) setDown(down bool) {
+	b.mu.Lock()
+	b.down = down
+	b.mu.Unlock()
+}
+
+func (b *flakyBackend) call() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls++
+	if b.down {
+		return errors.New("connection refused")
+	}
+
+	return nil
+}
+
+func (b *flakyBackend) GetState(key string) (int64, int64, error) {
+	if err := b.call(); err != nil {
+		return 0, 0, err
+	}
+
+	return b.backend.GetState(key)
+}
+
+func (b *flakyBackend) SetState(key string, allowance int64, lastAccessedTimestampNS int64) error {
+	if err := b.call(); err != nil {
+		return err
+	}
+
+	return b.backend.SetState(key, allowance, lastAccessedTimestampNS)
+}
+
+func TestFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy       FailurePolicy
+		wantErr      bool
+		wantAllowed  int
+		wantDegraded bool
+	}{
+		{FailError, true, 0, false},
+		{FailOpen, false, 11, true},
+		{FailClosed, false, 0, true},
+		{FailLocal, false, int(defaultTestBurst), true},
+	}
+
+	for _, test := range tests {
+		backend := &flakyBackend{backend: memory.New(), down: true}
+		limiter, _ := newTestLimiter(backend)
+		limiter.SetFailurePolicy(test.policy)
+		observer := &recordingObserver{}
+		limiter.AddObserver(observer)
+
+		allowed := 0
+		for i := 0; i < 11; i++ {
+			result, err := limiter.Allow("failure")
+			if (err != nil) != test.wantErr || result.Degraded != test.wantDegraded {
+				t.Logf("(%v) Allow() returned %+v err %v", test.policy, result, err)
+				t.Fail()
+				break
+			}
+
+			if err == nil && !errors.Is(observer.errors[i].Err, ErrBackendUnavailable) {
+				t.Logf("(%v) OnError received %+v", test.policy, observer.errors[i])
+				t.Fail()
+			}
+
+			if result.Allowed {
+				allowed++
+			}
+		}
+
+		if allowed != test.wantAllowed {
+			t.Logf("(%v) allowed %d requests, wanted %d", test.policy, allowed, test.wantAllowed)
+			t.Fail()
+		}
+
+		results, err := limiter.AllowMulti([]string{"failure:0", "failure:1"})
+		if (err != nil) != test.wantErr || (err == nil && (results[0].Degraded != test.wantDegraded || results[1].Degraded != test.wantDegraded)) {
+			t.Logf("(%v) AllowMulti() returned %+v err %v", test.policy, results, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestFailurePolicyCorruptState(t *testing.T) {
+	limiter, _ := newTestLimiter(&erroringBackend{fmt.Errorf("bad value: %w", ErrCorruptState)})
+	limiter.SetFailurePolicy(FailOpen)
+	if _, err := limiter.Allow("corrupt"); !errors.Is(err, ErrCorruptState) {
+		t.Logf("FailOpen on a corrupt key returned err %v", err)
+		t.Fail()
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	backend := &flakyBackend{backend: memory.New(), down: true}
+	limiter, clock := newTestLimiter(backend)
+	limiter.SetCircuitBreaker(2, time.Minute)
+	key := "breaker"
+
+	// every request makes a GetState() call before failing
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.Allow(key); !errors.Is(err, ErrBackendUnavailable) || errors.Is(err, ErrCircuitOpen) {
+			t.Logf("Allow() %d on a failing backend returned err %v", i, err)
+			t.Fail()
+		}
+	}
+
+	// the circuit is open so the backend is not called
+	if _, err := limiter.Allow(key); !errors.Is(err, ErrCircuitOpen) || !errors.Is(err, ErrBackendUnavailable) || backend.calls != 2 {
+		t.Logf("Allow() on an open circuit returned err %v after %d calls", err, backend.calls)
+		t.Fail()
+	}
+
+	// a failing probe opens the circuit for another cooldown
+	clock.Advance(time.Minute)
+	if _, err := limiter.Allow(key); errors.Is(err, ErrCircuitOpen) || backend.calls != 3 {
+		t.Logf("probe returned err %v after %d calls", err, backend.calls)
+		t.Fail()
+	}
+
+	if _, err := limiter.Allow(key); !errors.Is(err, ErrCircuitOpen) || backend.calls != 3 {
+		t.Logf("Allow() after a failed probe returned err %v after %d calls", err, backend.calls)
+		t.Fail()
+	}
+
+	// a successful probe closes the circuit
+	backend.setDown(false)
+	clock.Advance(time.Minute)
+	for i := 0; i < 2; i++ {
+		if result, err := limiter.Allow(key); err != nil || !result.Allowed || result.Degraded {
+			t.Logf("Allow() %d after recovering returned %+v err %v", i, result, err)
+			t.Fail()
+		}
+	}
+
+	// a new backend starts with a closed circuit
+	backend.setDown(true)
+	for i := 0; i < 2; i++ {
+		limiter.Allow(key)
+	}
+
+	limiter.SetBackend(memory.New())
+	if result, err := limiter.Allow(key); err != nil || !result.Allowed {
+		t.Logf("Allow() after SetBackend() returned %+v err %v", result, err)
+		t.Fail()
+	}
+}
+
+func TestFailurePolicyPenaltyAdaptiveOverdraft(t *testing.T) {
+	for _, policy := range []FailurePolicy{FailOpen, FailClosed, FailLocal} {
+		backend := &flakyBackend{backend: memory.New(), down: true}
+		limiter, _ := newTestLimiter(backend)
+		limiter.SetFailurePolicy(policy)
+		key := "failure:wrappers"
+
+		penalty := NewPenalty(limiter, time.Minute, time.Minute)
+		for i := 0; i < int(defaultTestBurst)+1; i++ {
+			if result, err := penalty.Allow(key); err != nil || !result.Degraded {
+				t.Logf("(%v) Penalty.Allow() returned %+v err %v", policy, result, err)
+				t.Fail()
+				break
+			}
+		}
+
+		adaptive := NewAdaptive(limiter, 1, 10)
+		if result, err := adaptive.Allow(key); err != nil || !result.Degraded {
+			t.Logf("(%v) Adaptive.Allow() returned %+v err %v", policy, result, err)
+			t.Fail()
+		}
+
+		if err := adaptive.Overloaded(key); err != nil {
+			t.Logf("(%v) Adaptive.Overloaded() returned err %v", policy, err)
+			t.Fail()
+		}
+
+		if rate, err := adaptive.Rate(key); err != nil || (policy != FailLocal && rate != defaultTestRate) {
+			t.Logf("(%v) Adaptive.Rate() returned %d err %v", policy, rate, err)
+			t.Fail()
+		}
+
+		overdraft, err := limiter.Overdraft(key+":overdraft", 2)
+		if err != nil || !overdraft.Result().Degraded {
+			t.Logf("(%v) Overdraft() returned %+v err %v", policy, overdraft, err)
+			t.Fail()
+			continue
+		}
+
+		// nothing was taken from the backend so nothing is settled there once it recovers
+		backend.setDown(false)
+		if err := overdraft.Settle(5); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, err := limiter.Status(key + ":overdraft"); err != nil || status.Allowance != defaultTestBurst {
+			t.Logf("(%v) Settle() of a degraded Overdraft left %+v err %v", policy, status, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestCircuitBreakerPenaltyAdaptive(t *testing.T) {
+	backend := &flakyBackend{backend: memory.New(), down: true}
+	limiter, _ := newTestLimiter(backend)
+	limiter.SetFailurePolicy(FailOpen)
+	limiter.SetCircuitBreaker(1, time.Minute)
+	key := "breaker:wrappers"
+
+	if _, err := limiter.Allow(key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	calls := backend.calls
+	if result, err := NewPenalty(limiter, time.Minute, time.Minute).Allow(key); err != nil || !result.Allowed {
+		t.Logf("Penalty.Allow() on an open circuit returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	if result, err := NewAdaptive(limiter, 1, 10).Allow(key); err != nil || !result.Allowed {
+		t.Logf("Adaptive.Allow() on an open circuit returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	if backend.calls != calls {
+		t.Logf("the backend received %d calls on an open circuit", backend.calls-calls)
+		t.Fail()
+	}
+}
+
+func TestFailurePolicyReservation(t *testing.T) {
+	for _, policy := range []FailurePolicy{FailOpen, FailLocal} {
+		backend := &flakyBackend{backend: memory.New()}
+		limiter, _ := newTestLimiter(backend)
+		limiter.SetFailurePolicy(policy)
+		key := "failure:reserve"
+		if err := limiter.SetAllowance(key, 0); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		backend.setDown(true)
+		reservation, err := limiter.Reserve(key, 5)
+		if err != nil || !reservation.OK() {
+			t.Fatalf("(%v) Reserve() returned %+v err %v", policy, reservation, err)
+		}
+
+		// the tokens were not taken from the backend so none may be returned to it once it recovers
+		backend.setDown(false)
+		if err := reservation.Cancel(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, err := limiter.Status(key); err != nil || status.Allowance != 0 {
+			t.Logf("(%v) Cancel() of a degraded reservation left %+v err %v", policy, status, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestCircuitBreakerAdmin(t *testing.T) {
+	backend := &flakyBackend{backend: memory.New()}
+	limiter, _ := newTestLimiter(backend)
+	limiter.SetCircuitBreaker(1, time.Minute)
+	key := "breaker:admin"
+
+	reservation, err := limiter.Reserve(key, 1)
+	if err != nil || !reservation.OK() {
+		t.Fatalf("Reserve() returned %+v err %v", reservation, err)
+	}
+
+	overdraft, err := limiter.Overdraft(key+":overdraft", 2)
+	if err != nil || !overdraft.Result().Allowed {
+		t.Fatalf("Overdraft() returned %+v err %v", overdraft, err)
+	}
+
+	backend.setDown(true)
+	if _, err := limiter.Allow(key); !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("Allow() on a failing backend returned err %v", err)
+	}
+
+	// the circuit is open so none of these call the backend
+	calls := backend.calls
+	ops := map[string]func() error{
+		"Status": func() error {
+			_, err := limiter.Status(key)
+			return err
+		},
+		"Reset":        func() error { return limiter.Reset(key) },
+		"SetAllowance": func() error { return limiter.SetAllowance(key, 1) },
+		"Credit":       func() error { return limiter.Credit(key, 1) },
+		"Delete":       func() error { return limiter.Delete(key) },
+		"Cancel":       reservation.Cancel,
+		"Settle":       func() error { return overdraft.Settle(5) },
+	}
+
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, ErrCircuitOpen) || !errors.Is(err, ErrBackendUnavailable) {
+			t.Logf("%s() on an open circuit returned err %v", name, err)
+			t.Fail()
+		}
+	}
+
+	if backend.calls != calls {
+		t.Logf("the backend received %d calls on an open circuit", backend.calls-calls)
+		t.Fail()
+	}
+}
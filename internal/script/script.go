@@ -0,0 +1,202 @@
+// Package script holds the lua sources shared by the redis backends (beeekind/ratelimit/redigo and
+// beeekind/ratelimit/radix) so both evaluate the exact same algorithm server side.
+//
+// Timestamps are nanoseconds since the unix epoch which do not fit in a lua number (a double) without
+// losing precision, so they are passed and stored as strings and split into seconds and nanoseconds
+// before any arithmetic is done on them.
+package script
+
+// CorruptStateError prefixes the error replied by a script when the state stored at a key cannot be parsed,
+// backends map it to ratelimit.ErrCorruptState
+const CorruptStateError = "CORRUPT"
+
+// helpers are the lua functions shared by every script, they mirror refillAllowance() and takeAllowance()
+// in beeekind/ratelimit
+const helpers = `
+local function split(ts)
+	if #ts <= 9 then
+		return 0, tonumber(ts)
+	end
+	return tonumber(string.sub(ts, 1, -10)), tonumber(string.sub(ts, -9))
+end
+
+local function elapsed(from, to)
+	local fromS, fromNS = split(from)
+	local toS, toNS = split(to)
+	return (toS - fromS) * 1000000000 + (toNS - fromNS)
+end
+
+-- readState returns the allowance and lastAccessedTimestampNS stored in the hash set at key, or nil and
+-- an error reply if they cannot be parsed
+local function readState(key)
+	local state = redis.call('HMGET', key, '0', '1')
+	if (state[1] == false) ~= (state[2] == false) then
+		return nil, redis.error_reply('CORRUPT hash set ' .. key .. ' is missing a field')
+	end
+
+	local allowance = tonumber(state[1] or '0')
+	local accessed = state[2] or '0'
+	if allowance == nil or string.match(accessed, '^%d+$') == nil then
+		return nil, redis.error_reply('CORRUPT hash set ' .. key .. ' cannot be parsed')
+	end
+
+	return allowance, accessed
+end
+
+-- advance returns the timestamp ts moved forward by ns nanoseconds
+local function advance(ts, ns)
+	local s, n = split(ts)
+	n = n + ns
+	s = s + math.floor(n / 1000000000)
+	n = n % 1000000000
+	if s == 0 then
+		return string.format('%d', n)
+	end
+	return string.format('%d%09d', s, n)
+end
+
+-- refill only advances accessed by the whole intervals refilled so partial progress is kept, and sets it
+-- to now once the bucket is full
+local function refill(allowance, accessed, now, rate, interval, burst)
+	if allowance >= burst then
+		return allowance, now
+	end
+
+	local intervals = math.floor(elapsed(accessed, now) / interval)
+	if intervals < 1 or rate < 1 then
+		return allowance, accessed
+	end
+
+	if intervals >= math.ceil((burst - allowance) / rate) then
+		return burst, now
+	end
+	return allowance + rate * intervals, advance(accessed, intervals * interval)
+end
+
+-- spend returns whether cost tokens can be taken from allowance while leaving floor tokens, and the allowance
+-- after taking them
+local function spend(allowance, cost, burst, floor)
+	if cost < 0 then
+		-- returned tokens never fill the bucket beyond burst, or beyond an allowance already larger than burst
+		return true, math.min(allowance - cost, math.max(allowance, burst))
+	end
+	if allowance - cost >= floor then
+		return true, allowance - cost
+	end
+	return false, allowance
+end
+`
+
+// Take refills the bucket stored in the hash set at KEYS[1] and spends ARGV[1] tokens from it when
+// enough are available above floor, writing the new state back in the same round trip. A negative cost
+// returns tokens to the bucket without filling it beyond burst.
+//
+// ARGV: cost, rate, interval (ns), burst, now (ns), floor
+//
+// Returns {allowed (1 or 0), allowance, lastAccessedTimestampNS (string)}
+const Take = helpers + `
+local cost = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local burst = tonumber(ARGV[4])
+local now = ARGV[5]
+local floor = tonumber(ARGV[6] or '0')
+
+local allowance, accessed = readState(KEYS[1])
+if allowance == nil then
+	return accessed
+end
+
+allowance, accessed = refill(allowance, accessed, now, rate, interval, burst)
+
+local ok
+ok, allowance = spend(allowance, cost, burst, floor)
+
+redis.call('HSET', KEYS[1], '0', allowance, '1', accessed)
+if ok then
+	return {1, allowance, accessed}
+end
+return {0, allowance, accessed}
+`
+
+// TakeAll refills the bucket stored in the hash set at every key and spends ARGV[1] tokens from each of them that
+// has enough. When ARGV[3] is 1 tokens are spent from all of them or from none of them, and state is only written
+// when they are spent, otherwise every bucket is handled like Take.
+//
+// ARGV: cost, now (ns), atomic (1 or 0), then rate, interval (ns), burst for each key
+//
+// Returns {allowed (1 or 0), allowance, lastAccessedTimestampNS (string)} for each key, where allowed reports
+// whether the bucket had enough tokens
+const TakeAll = helpers + `
+local cost = tonumber(ARGV[1])
+local now = ARGV[2]
+local atomic = ARGV[3] == '1'
+
+local all = true
+local states = {}
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[3 * i + 1])
+	local interval = tonumber(ARGV[3 * i + 2])
+	local burst = tonumber(ARGV[3 * i + 3])
+
+	local allowance, accessed = readState(key)
+	if allowance == nil then
+		return accessed
+	end
+
+	allowance, accessed = refill(allowance, accessed, now, rate, interval, burst)
+
+	local ok, spent = spend(allowance, cost, burst, 0)
+	if not ok then
+		all = false
+	end
+
+	states[i] = {ok, allowance, spent, accessed}
+end
+
+local reply = {}
+for i, key in ipairs(KEYS) do
+	local ok, allowance, spent, accessed = states[i][1], states[i][2], states[i][3], states[i][4]
+	if not atomic or all then
+		allowance = spent
+		redis.call('HSET', key, '0', allowance, '1', accessed)
+	end
+
+	if ok then
+		table.insert(reply, 1)
+	else
+		table.insert(reply, 0)
+	end
+	table.insert(reply, allowance)
+	table.insert(reply, accessed)
+end
+return reply
+`
+
+// AcquireLease adds the lease ARGV[1] to the sorted set at KEYS[1], scored by its expiry, when fewer than ARGV[2]
+// unexpired leases are held. Expired leases are removed first and the sorted set expires with its last lease.
+//
+// Scores are unix milliseconds rather than nanoseconds so that they are exact in a double.
+//
+// ARGV: id, limit, expires (ms), now (ms)
+//
+// Returns {acquired (1 or 0), leases held after the call}
+const AcquireLease = `
+local limit = tonumber(ARGV[2])
+local expires = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+
+local held = redis.call('ZCARD', KEYS[1])
+if held >= limit then
+	return {0, held}
+end
+
+redis.call('ZADD', KEYS[1], expires, ARGV[1])
+
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('PEXPIRE', KEYS[1], tonumber(last[2]) - now + 1)
+
+return {1, redis.call('ZCARD', KEYS[1])}
+`
@@ -0,0 +1,42 @@
+// Package stripe spreads keys across a fixed number of stripes, for example mutexes or shards, and gives the order
+// in which the stripes of several keys must be locked. It is shared by beeekind/ratelimit and
+// beeekind/ratelimit/memory so both hash keys the same way.
+package stripe
+
+import (
+	"sort"
+)
+
+// Index returns the index of the stripe out of n responsible for key using an inlined 32 bit FNV-1a hash to avoid
+// allocating
+func Index(key string, n int) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+
+	return int(hash % uint32(n))
+}
+
+// Indexes returns the indexes of the stripes out of n responsible for keys in ascending order and without
+// duplicates, since several keys may share a stripe which must only be locked once. Locking the stripes in this
+// order ensures that two callers locking overlapping keys cannot deadlock
+func Indexes(keys []string, n int) []int {
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, Index(key, n))
+	}
+
+	sort.Ints(indexes)
+	unique := indexes[:0]
+	for i, index := range indexes {
+		if i > 0 && index == indexes[i-1] {
+			continue
+		}
+
+		unique = append(unique, index)
+	}
+
+	return unique
+}
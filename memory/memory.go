@@ -1,11 +1,26 @@
 package memory
 
-import "sync"
+import (
+	"context"
+	"sync"
+
+	"github.com/beeekind/ratelimit/internal/stripe"
+)
+
+// shardCount is the number of independently locked maps keys are spread across so that
+// unrelated keys don't contend on the same mutex
+const shardCount = 64
 
 // Backend ...
 type Backend struct {
+	shards []*shard
+}
+
+type shard struct {
 	mu   *sync.RWMutex
 	data map[string]*state
+	// leases maps a key to the expiry in nanoseconds of every lease it holds, by lease id
+	leases map[string]map[string]int64
 }
 
 type state struct {
@@ -13,32 +28,128 @@ type state struct {
 	lastAllowedTimestampNS int64
 }
 
-// New returns a new instance of memory.Backend 
+// New returns a new instance of memory.Backend
 func New() *Backend {
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{
+			mu:     &sync.RWMutex{},
+			data:   make(map[string]*state),
+			leases: make(map[string]map[string]int64),
+		}
+	}
+
 	return &Backend{
-		mu:   &sync.RWMutex{},
-		data: make(map[string]*state),
+		shards: shards,
 	}
 }
 
+// shard returns the shard responsible for key
+func (b *Backend) shard(key string) *shard {
+	return b.shards[stripe.Index(key, len(b.shards))]
+}
+
 // GetState ...
 func (b *Backend) GetState(key string) (allowance int64, lastAllowedTimestampNS int64, err error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	data, exists := b.data[key]
+	s := b.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, exists := s.data[key]
 	if !exists {
-		return 0, 0, nil 
+		return 0, 0, nil
 	}
 	return data.allowance, data.lastAllowedTimestampNS, nil
 }
 
 // SetState ...
 func (b *Backend) SetState(key string, allowance int64, lastAllowedTimestampNS int64) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.data[key] = &state{
+	s := b.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = &state{
 		allowance:              allowance,
 		lastAllowedTimestampNS: lastAllowedTimestampNS,
 	}
 	return nil
 }
+
+// Delete implements ratelimit.Deleter by removing the state stored at key
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	s := b.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+// Update implements ratelimit.UpdateBackend. It calls fn with the state stored at every key while holding their
+// shards locked, and stores the states fn leaves in the slices if it returns true. Shards are locked in ascending
+// order so concurrent calls with overlapping keys cannot deadlock
+func (b *Backend) Update(keys []string, fn func(allowances, lastAllowedTimestampsNS []int64) bool) error {
+	for _, index := range stripe.Indexes(keys, len(b.shards)) {
+		b.shards[index].mu.Lock()
+		defer b.shards[index].mu.Unlock()
+	}
+
+	allowances := make([]int64, len(keys))
+	lastAllowedTimestampsNS := make([]int64, len(keys))
+	for i, key := range keys {
+		if data, exists := b.shard(key).data[key]; exists {
+			allowances[i] = data.allowance
+			lastAllowedTimestampsNS[i] = data.lastAllowedTimestampNS
+		}
+	}
+
+	if !fn(allowances, lastAllowedTimestampsNS) {
+		return nil
+	}
+
+	for i, key := range keys {
+		b.shard(key).data[key] = &state{
+			allowance:              allowances[i],
+			lastAllowedTimestampNS: lastAllowedTimestampsNS[i],
+		}
+	}
+
+	return nil
+}
+
+// AcquireLease implements ratelimit.LeaseBackend
+func (b *Backend) AcquireLease(ctx context.Context, key, id string, limit, expires, now int64) (acquired bool, held int64, err error) {
+	s := b.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	leases := s.leases[key]
+	for leaseID, leaseExpires := range leases {
+		if leaseExpires <= now {
+			delete(leases, leaseID)
+		}
+	}
+
+	if int64(len(leases)) >= limit {
+		return false, int64(len(leases)), nil
+	}
+
+	if leases == nil {
+		leases = make(map[string]int64)
+		s.leases[key] = leases
+	}
+
+	leases[id] = expires
+	return true, int64(len(leases)), nil
+}
+
+// ReleaseLease implements ratelimit.LeaseBackend
+func (b *Backend) ReleaseLease(ctx context.Context, key, id string) error {
+	s := b.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leases[key], id)
+	if len(s.leases[key]) == 0 {
+		delete(s.leases, key)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AllowMulti is shorthand for AllowMultiContext(context.Background(), keys)
+func (rl *RateLimit) AllowMulti(keys []string) ([]Result, error) {
+	return rl.AllowMultiContext(context.Background(), keys)
+}
+
+// AllowMultiContext spends a token from each of keys that has one, as if Allow() had been called for every key, and
+// returns a Result per key indexed like keys. The keys are evaluated in a single script if the backend implements
+// MultiBackend, under the backend locks if it implements UpdateBackend, or else under the striped key locks of the
+// RateLimit. Note that on a redis cluster the keys must hash to the same slot
+func (rl *RateLimit) AllowMultiContext(ctx context.Context, keys []string) ([]Result, error) {
+	return rl.allowMulti(ctx, keys, false)
+}
+
+// AllowAll is shorthand for AllowAllContext(context.Background(), keys)
+func (rl *RateLimit) AllowAll(keys []string) ([]Result, error) {
+	return rl.AllowAllContext(context.Background(), keys)
+}
+
+// AllowAllContext is AllowMultiContext() with all-or-nothing semantics: a token is spent from every key if all of
+// them have one, or from none of them, in which case Result.Allowed is false for every key and Result.RetryAfter
+// is only set for the keys that lacked a token
+func (rl *RateLimit) AllowAllContext(ctx context.Context, keys []string) ([]Result, error) {
+	return rl.allowMulti(ctx, keys, true)
+}
+
+// allowMulti spends a token from keys with takeAll() and returns a Result per key
+func (rl *RateLimit) allowMulti(ctx context.Context, keys []string, atomic bool) (results []Result, err error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// every key is reported to the observers, with the latency of the backend shared by the keys that reached it
+	observed := rl.config()
+	matched := make([]bool, len(keys))
+	var latency time.Duration
+	var failure error
+	defer func() {
+		for i, key := range keys {
+			event := Event{Key: key, Cost: 1, Err: err}
+			if err == nil {
+				event.Result = results[i]
+				if !matched[i] {
+					event.Latency = latency
+					event.Err = failure
+				}
+			}
+			observed.notify(event)
+		}
+	}()
+
+	seen := make(map[string]bool, len(keys))
+	cfgs := make([]config, len(keys))
+	for i, key := range keys {
+		if seen[key] {
+			return nil, fmt.Errorf("failed to allowMulti: key %q appears more than once", key)
+		}
+		seen[key] = true
+
+		cfg, err := rl.configFor(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+
+		cfgs[i] = cfg
+	}
+
+	// keys matching an allow or deny Rule are decided without the backend. When a denied key rejects an atomic
+	// batch nothing is spent from the other keys, they are only refilled to report their Remaining
+	results = make([]Result, len(keys))
+	var limitedKeys []string
+	var limitedCfgs []config
+	denied := false
+	for i, cfg := range cfgs {
+		results[i], matched[i] = cfg.matchRules(keys[i])
+		if !matched[i] {
+			limitedKeys = append(limitedKeys, keys[i])
+			limitedCfgs = append(limitedCfgs, cfg)
+		} else if results[i].Rule != nil && !results[i].Allowed {
+			denied = true
+		}
+	}
+
+	cost := int64(1)
+	if atomic && denied {
+		cost = 0
+	}
+
+	var allowed []bool
+	var allowances, lastAccessedTimestampsNS []int64
+	// every key has the backend and clock of the RateLimit, a PolicyResolver only changes their Limit
+	currentTime := cfgs[0].clock.Now().UnixNano()
+	if len(limitedKeys) > 0 {
+		start := time.Now()
+		failure, err = cfgs[0].guard(ctx, "allowMulti", func(cfg config) (err error) {
+			allowed, allowances, lastAccessedTimestampsNS, err = takeAll(ctx, cfg.backend, rl.keyLocks, limitedKeys, limitedCfgs, cost, atomic, currentTime)
+			return err
+		})
+		latency = time.Since(start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// FailOpen and FailClosed decide every key that needed the backend the same way
+	degraded := failure != nil && cfgs[0].failurePolicy != FailLocal
+	if degraded {
+		allowed = make([]bool, len(limitedKeys))
+		for j := range allowed {
+			allowed[j] = cfgs[0].failurePolicy == FailOpen
+		}
+	}
+
+	all := !denied
+	for _, ok := range allowed {
+		all = all && ok
+	}
+
+	j := 0
+	for i, cfg := range cfgs {
+		if matched[i] {
+			if atomic && !all && results[i].Allowed && !results[i].DryRun {
+				results[i].Allowed = false
+				results[i] = cfg.admit(results[i])
+			}
+			continue
+		}
+
+		if degraded {
+			results[i] = cfg.failedResult()
+			if atomic && !all && results[i].Allowed {
+				results[i].Allowed = false
+				results[i] = cfg.admit(results[i])
+			}
+		} else {
+			results[i] = newResult(cfg, currentTime, allowed[j] && (all || !atomic), allowances[j], lastAccessedTimestampsNS[j], 1, 0)
+			results[i].Degraded = failure != nil
+		}
+		j++
+	}
+
+	return results, nil
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"testing"
+)
+
+func TestAllowMulti(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, _ := newTestLimiter(backend)
+		keys := []string{"multi:user", "multi:ip"}
+
+		if err := limiter.SetAllowance(keys[1], 1); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		results, err := limiter.AllowMulti(keys)
+		if err != nil || len(results) != 2 || !results[0].Allowed || !results[1].Allowed {
+			t.Logf("(%s) first AllowMulti() returned %+v err %v", name, results, err)
+			t.Fail()
+			continue
+		}
+
+		if results[0].Remaining != defaultTestBurst-1 || results[1].Remaining != 0 {
+			t.Logf("(%s) first AllowMulti() returned remaining %d and %d", name, results[0].Remaining, results[1].Remaining)
+			t.Fail()
+		}
+
+		// the second key is empty, the first one is still charged
+		results, err = limiter.AllowMulti(keys)
+		if err != nil || !results[0].Allowed || results[1].Allowed || results[1].RetryAfter != defaultTestInterval {
+			t.Logf("(%s) second AllowMulti() returned %+v err %v", name, results, err)
+			t.Fail()
+		}
+
+		if status, err := limiter.Status(keys[0]); err != nil || status.Allowance != defaultTestBurst-2 {
+			t.Logf("(%s) first key has %+v err %v after AllowMulti()", name, status, err)
+			t.Fail()
+		}
+
+		if _, err := limiter.AllowMulti([]string{"multi:user", "multi:user"}); err == nil {
+			t.Logf("(%s) AllowMulti() with a duplicate key returned no error", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, clock := newTestLimiter(backend)
+		keys := []string{"all:user", "all:ip"}
+
+		if err := limiter.SetAllowance(keys[1], 0); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// the second key is empty so the first key must not be charged
+		results, err := limiter.AllowAll(keys)
+		if err != nil || len(results) != 2 || results[0].Allowed || results[1].Allowed {
+			t.Logf("(%s) AllowAll() returned %+v err %v", name, results, err)
+			t.Fail()
+			continue
+		}
+
+		if results[0].RetryAfter != 0 || results[1].RetryAfter != defaultTestInterval {
+			t.Logf("(%s) AllowAll() returned retry after %v and %v", name, results[0].RetryAfter, results[1].RetryAfter)
+			t.Fail()
+		}
+
+		if status, err := limiter.Status(keys[0]); err != nil || status.Allowance != defaultTestBurst {
+			t.Logf("(%s) first key has %+v err %v after a rejected AllowAll()", name, status, err)
+			t.Fail()
+		}
+
+		clock.Advance(defaultTestInterval)
+		results, err = limiter.AllowAll(keys)
+		if err != nil || !results[0].Allowed || !results[1].Allowed || results[0].Remaining != defaultTestBurst-1 {
+			t.Logf("(%s) AllowAll() after refilling returned %+v err %v", name, results, err)
+			t.Fail()
+		}
+	}
+}
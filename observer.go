@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// Observer receives the decisions and configuration changes of a RateLimit, for example to count, log or alert on
+// them. Observers are called synchronously from Allow() and the Set methods so they should return quickly, and
+// they may be called concurrently. Embed NopObserver to implement only some of the methods
+type Observer interface {
+	// OnAllow is called when a request is admitted, including by an allow Rule or in dry-run mode
+	OnAllow(event Event)
+	// OnDeny is called when a request is rejected
+	OnDeny(event Event)
+	// OnError is called when a request fails with Event.Err
+	OnError(event Event)
+	// OnConfigChange is called after SetRate(), SetBurst(), SetInterval() or SetBackend()
+	OnConfigChange(change ConfigChange)
+}
+
+// Event describes a request decided by a RateLimit
+type Event struct {
+	// Key is the key of the request
+	Key string
+	// Cost is the number of tokens requested
+	Cost int64
+	// Result is the Result returned to the caller, holding Remaining and RetryAfter among others. It is the zero
+	// Result for OnError unless the error was handled by the FailurePolicy
+	Result Result
+	// Latency is the time.Duration spent in the backend, zero if the request was decided without reaching it
+	Latency time.Duration
+	// Err is the error returned to the caller, or the failure of the backend handled by the FailurePolicy with
+	// Result.Degraded set, only set for OnError
+	Err error
+}
+
+// ConfigChange describes a change of the configuration of a RateLimit
+type ConfigChange struct {
+	// Field is the name of the setting that changed, i.e. "rate", "burst", "interval" or "backend"
+	Field string
+	// Old and New are the values of the setting before and after the change
+	Old interface{}
+	New interface{}
+}
+
+// NopObserver implements Observer with methods that do nothing, so that an Observer embedding it only has to
+// implement the methods it needs
+type NopObserver struct{}
+
+// OnAllow implements Observer
+func (NopObserver) OnAllow(event Event) {}
+
+// OnDeny implements Observer
+func (NopObserver) OnDeny(event Event) {}
+
+// OnError implements Observer
+func (NopObserver) OnError(event Event) {}
+
+// OnConfigChange implements Observer
+func (NopObserver) OnConfigChange(change ConfigChange) {}
+
+// AddObserver registers observer to be called on every decision and configuration change, using a RWMutex to lock
+// the struct for safe concurrent use. Observers are called in the order they were added
+func (rl *RateLimit) AddObserver(observer Observer) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// the slice is copied so that snapshots taken by config() are never mutated
+	observers := make([]Observer, len(rl.observers), len(rl.observers)+1)
+	copy(observers, rl.observers)
+	rl.observers = append(observers, observer)
+}
+
+// notify calls OnError, OnAllow or OnDeny of every observer of c depending on event
+func (c config) notify(event Event) {
+	for _, observer := range c.observers {
+		switch {
+		case event.Err != nil:
+			observer.OnError(event)
+		case event.Result.Allowed:
+			observer.OnAllow(event)
+		default:
+			observer.OnDeny(event)
+		}
+	}
+}
+
+// notifyChange calls OnConfigChange of every one of observers with change
+func notifyChange(observers []Observer, change ConfigChange) {
+	for _, observer := range observers {
+		observer.OnConfigChange(change)
+	}
+}
@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+// recordingObserver records the events it receives by kind
+type recordingObserver struct {
+	mu      sync.Mutex
+	allows  []Event
+	denies  []Event
+	errors  []Event
+	changes []ConfigChange
+}
+
+func (o *recordingObserver) OnAllow(event Event) {
+	o.mu.Lock()
+	o.allows = append(o.allows, event)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) OnDeny(event Event) {
+	o.mu.Lock()
+	o.denies = append(o.denies, event)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) OnError(event Event) {
+	o.mu.Lock()
+	o.errors = append(o.errors, event)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) OnConfigChange(change ConfigChange) {
+	o.mu.Lock()
+	o.changes = append(o.changes, change)
+	o.mu.Unlock()
+}
+
+// denyCounter only counts denials, NopObserver implements the rest
+type denyCounter struct {
+	NopObserver
+	denies int
+}
+
+func (c *denyCounter) OnDeny(event Event) {
+	c.denies++
+}
+
+func TestObserver(t *testing.T) {
+	limiter, _ := newTestLimiter(memory.New())
+	observer := &recordingObserver{}
+	counter := &denyCounter{}
+	limiter.AddObserver(observer)
+	limiter.AddObserver(counter)
+	key := "observer"
+
+	if _, err := limiter.AllowN(key, defaultTestBurst); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := limiter.Allow(key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(observer.allows) != 1 || len(observer.denies) != 1 || counter.denies != 1 {
+		t.Fatalf("observers received %d allows, %d and %d denies", len(observer.allows), len(observer.denies), counter.denies)
+	}
+
+	allow := observer.allows[0]
+	if allow.Key != key || allow.Cost != defaultTestBurst || allow.Result.Remaining != 0 || allow.Latency <= 0 {
+		t.Logf("OnAllow received %+v", allow)
+		t.Fail()
+	}
+
+	deny := observer.denies[0]
+	if deny.Key != key || deny.Cost != 1 || deny.Result.Allowed || deny.Result.RetryAfter != defaultTestInterval {
+		t.Logf("OnDeny received %+v", deny)
+		t.Fail()
+	}
+
+	connectionRefused := errors.New("connection refused")
+	limiter.SetBackend(&erroringBackend{connectionRefused})
+	if _, err := limiter.Allow(key); err == nil {
+		t.Fatal("Allow() on a failing backend returned no error")
+	}
+
+	if len(observer.errors) != 1 || !errors.Is(observer.errors[0].Err, connectionRefused) {
+		t.Logf("OnError received %+v", observer.errors)
+		t.Fail()
+	}
+
+	limiter.SetRate(5)
+	limiter.SetBurst(20)
+	limiter.SetInterval(2 * defaultTestInterval)
+
+	want := []ConfigChange{
+		{Field: "rate", Old: defaultTestRate, New: int64(5)},
+		{Field: "burst", Old: defaultTestBurst, New: int64(20)},
+		{Field: "interval", Old: defaultTestInterval, New: 2 * defaultTestInterval},
+	}
+	if len(observer.changes) != 1+len(want) {
+		t.Fatalf("OnConfigChange received %+v", observer.changes)
+	}
+
+	if change := observer.changes[0]; change.Field != "backend" || change.New != limiter.backend {
+		t.Logf("OnConfigChange 0 received %+v", change)
+		t.Fail()
+	}
+
+	for i, change := range observer.changes[1:] {
+		if change != want[i] {
+			t.Logf("OnConfigChange %d received %+v, wanted %+v", i+1, change, want[i])
+			t.Fail()
+		}
+	}
+}
+
+func TestObserverMulti(t *testing.T) {
+	limiter, _ := newTestLimiter(memory.New())
+	observer := &recordingObserver{}
+	limiter.AddObserver(observer)
+	if err := limiter.SetAllowList(Rule{Kind: ExactRule, Pattern: "healthcheck"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := limiter.SetAllowance("empty", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := limiter.AllowMulti([]string{"healthcheck", "user", "empty"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(observer.allows) != 2 || len(observer.denies) != 1 {
+		t.Fatalf("observer received %+v allows and %+v denies", observer.allows, observer.denies)
+	}
+
+	// keys decided by a Rule never reach the backend
+	if observer.allows[0].Key != "healthcheck" || observer.allows[0].Latency != 0 || observer.allows[1].Latency <= 0 {
+		t.Logf("observer received allows %+v", observer.allows)
+		t.Fail()
+	}
+
+	if observer.denies[0].Key != "empty" {
+		t.Logf("observer received denies %+v", observer.denies)
+		t.Fail()
+	}
+}
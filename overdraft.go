@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Overdraft holds the tokens taken by RateLimit.Overdraft() for a request whose cost is only known once it has been
+// handled, for example the tokens generated by a model or the bytes of an export. Settle() charges or returns the
+// difference between the estimate and the actual cost
+type Overdraft struct {
+	rl       *RateLimit
+	key      string
+	estimate int64
+	result   Result
+	// charged is true when the estimate was taken from the bucket, it is false for rejected requests and for
+	// requests admitted by an allow Rule or dry-run mode
+	charged bool
+	// mu protects settled so that the difference is charged at most once
+	mu      *sync.Mutex
+	settled bool
+}
+
+// Overdraft admits a request for key with an estimated cost, letting the allowance of key go below zero down to
+// -RateLimit.debtLimit. While a key is in debt Allow() rejects its requests until refills have repaid the debt, so
+// expensive requests are paid for by delaying the following ones instead of being rejected up front.
+//
+// The request is rejected when the estimate would take the allowance below the debt limit, the same errors as
+// AllowN() are returned otherwise, and ErrExceedsBurst when the estimate is larger than burst plus the debt limit
+func (rl *RateLimit) Overdraft(key string, estimate int64) (*Overdraft, error) {
+	ctx := context.Background()
+	cfg, err := rl.configFor(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	if estimate < 1 {
+		return nil, fmt.Errorf("failed to overdraft: estimate must be positive, got %d", estimate)
+	}
+
+	overdraft := &Overdraft{
+		rl:       rl,
+		key:      key,
+		estimate: estimate,
+		mu:       &sync.Mutex{},
+	}
+
+	if result, ok := cfg.matchRules(key); ok {
+		overdraft.result = result
+		cfg.notify(Event{Key: key, Cost: estimate, Result: result})
+		return overdraft, nil
+	}
+
+	if estimate > cfg.burst+cfg.debtLimit {
+		return nil, fmt.Errorf("failed to overdraft: %w (%d > %d)", ErrExceedsBurst, estimate, cfg.burst+cfg.debtLimit)
+	}
+
+	var allowed bool
+	var allowance, lastAccessedTimestampNS int64
+	currentTime := cfg.clock.Now().UnixNano()
+	start := time.Now()
+	failure, err := cfg.guard(ctx, "overdraft", func(cfg config) (err error) {
+		allowed, allowance, lastAccessedTimestampNS, err = take(ctx, rl.keyLocks, cfg, key, estimate, -cfg.debtLimit, currentTime)
+		return err
+	})
+	latency := time.Since(start)
+	if err != nil {
+		cfg.notify(Event{Key: key, Cost: estimate, Latency: latency, Err: err})
+		return nil, err
+	}
+
+	if failure != nil && cfg.failurePolicy != FailLocal {
+		overdraft.result = cfg.failedResult()
+	} else {
+		overdraft.result = newResult(cfg, currentTime, allowed, allowance, lastAccessedTimestampNS, estimate, -cfg.debtLimit)
+		overdraft.result.Degraded = failure != nil
+	}
+
+	// a degraded estimate was not taken from the backend, settling it there would charge or return tokens that were
+	// never taken
+	overdraft.charged = allowed && failure == nil
+	cfg.notify(Event{Key: key, Cost: estimate, Result: overdraft.result, Latency: latency, Err: failure})
+	return overdraft, nil
+}
+
+// OK reports whether the request was admitted
+func (o *Overdraft) OK() bool {
+	return o.result.Allowed
+}
+
+// Result returns the Result of the admission, Result.Remaining is negative if the estimate put the key in debt
+func (o *Overdraft) Result() Result {
+	return o.result
+}
+
+// Settle charges the bucket for actual - estimate more tokens, or returns estimate - actual tokens to it without
+// filling it beyond burst. An extra charge never takes the allowance below the debt limit, the part of it that
+// does not fit is forgiven.
+//
+// Settle is a no-op if the estimate was never taken from the bucket or the Overdraft has already been settled
+func (o *Overdraft) Settle(actual int64) error {
+	if actual < 0 {
+		return fmt.Errorf("failed to settle: actual cost must not be negative, got %d", actual)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.charged || o.settled {
+		return nil
+	}
+
+	ctx := context.Background()
+	cfg, err := o.rl.configFor(ctx, o.key)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	difference := actual - o.estimate
+	for difference != 0 {
+		var allowed bool
+		var allowance int64
+		err := cfg.call(ctx, "settle", func(cfg config) (err error) {
+			allowed, allowance, _, err = take(ctx, o.rl.keyLocks, cfg, o.key, difference, -cfg.debtLimit, cfg.clock.Now().UnixNano())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if allowed {
+			break
+		}
+
+		// charge what is left above the debt limit, it shrinks on every attempt since the whole difference did not
+		// fit so this only loops again if a concurrent request spent from the bucket in between
+		difference = allowance + cfg.debtLimit
+		if difference <= 0 {
+			break
+		}
+	}
+
+	o.settled = true
+	return nil
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOverdraft(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, clock := newTestLimiter(backend)
+		limiter.SetDebtLimit(5)
+		key := "overdraft"
+
+		// the estimate puts the key 2 tokens into debt
+		overdraft, err := limiter.Overdraft(key, defaultTestBurst+2)
+		if err != nil || !overdraft.OK() || overdraft.Result().Remaining != -2 {
+			t.Fatalf("(%s) Overdraft() returned %+v err %v", name, overdraft, err)
+		}
+
+		// the actual cost was 1 more than estimated
+		if err := overdraft.Settle(defaultTestBurst + 3); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// settling twice is a no-op
+		if err := overdraft.Settle(0); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, err := limiter.Status(key); err != nil || status.Allowance != -3 {
+			t.Logf("(%s) Settle() left %+v err %v", name, status, err)
+			t.Fail()
+		}
+
+		// requests are delayed until the debt is repaid
+		result, err := limiter.Allow(key)
+		if err != nil || result.Allowed || result.RetryAfter != 4*defaultTestInterval {
+			t.Logf("(%s) Allow() in debt returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		// the estimate would go beyond the debt limit
+		if overdraft, err = limiter.Overdraft(key, 3); err != nil || overdraft.OK() || overdraft.Result().RetryAfter != defaultTestInterval {
+			t.Logf("(%s) Overdraft() beyond the debt limit returned %+v err %v", name, overdraft, err)
+			t.Fail()
+		}
+
+		clock.Advance(4 * defaultTestInterval)
+		if result, err = limiter.Allow(key); err != nil || !result.Allowed || result.Remaining != 0 {
+			t.Logf("(%s) Allow() after repaying the debt returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		if _, err := limiter.Overdraft(key, defaultTestBurst+6); !errors.Is(err, ErrExceedsBurst) {
+			t.Logf("(%s) Overdraft() larger than burst and debt limit returned err %v", name, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestOverdraftSettle(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, _ := newTestLimiter(backend)
+		limiter.SetDebtLimit(5)
+		key := "settle"
+
+		// a cheaper request than estimated returns the difference
+		overdraft, err := limiter.Overdraft(key, 4)
+		if err != nil || !overdraft.OK() {
+			t.Fatalf("(%s) Overdraft() returned %+v err %v", name, overdraft, err)
+		}
+
+		if err := overdraft.Settle(1); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, err := limiter.Status(key); err != nil || status.Allowance != defaultTestBurst-1 {
+			t.Logf("(%s) Settle() below the estimate left %+v err %v", name, status, err)
+			t.Fail()
+		}
+
+		// a charge beyond the debt limit is forgiven
+		if overdraft, err = limiter.Overdraft(key, defaultTestBurst); err != nil || !overdraft.OK() {
+			t.Fatalf("(%s) second Overdraft() returned %+v err %v", name, overdraft, err)
+		}
+
+		if err := overdraft.Settle(defaultTestBurst + 100); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, err := limiter.Status(key); err != nil || status.Allowance != -5 {
+			t.Logf("(%s) Settle() beyond the debt limit left %+v err %v", name, status, err)
+			t.Fail()
+		}
+
+		if err := overdraft.Settle(-1); err == nil {
+			t.Logf("(%s) Settle() with a negative cost returned no error", name)
+			t.Fail()
+		}
+	}
+}
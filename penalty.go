@@ -0,0 +1,208 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Penalty locks out keys that keep being limited by a RateLimit for escalating periods, for example on login or
+// signup endpoints. Every request the RateLimit rejects is a violation, and the n-th violation locks the key out
+// for the n-th duration of the schedule (the last duration repeats). Requests made during a lockout are rejected
+// without reaching the RateLimit and are not counted as violations. Keys matching an allow or deny Rule of the
+// RateLimit are decided by the Rule alone, so a deny Rule never counts as a violation.
+//
+// Only clean behaviour decays the penalty: one violation is forgiven for every decay that passes after the last
+// lockout ended without a new violation. The violations of a key are stored in the backend of the RateLimit under
+// the key suffixed with ":penalty", as the number of violations and the time of the last one
+type Penalty struct {
+	rl *RateLimit
+	// mu protects schedule and decay from concurrent Set calls
+	mu       *sync.RWMutex
+	schedule []time.Duration
+	decay    time.Duration
+}
+
+// NewPenalty returns a new instance of Penalty on top of rl. A decay <= 0 never forgives violations
+func NewPenalty(rl *RateLimit, decay time.Duration, schedule ...time.Duration) *Penalty {
+	return &Penalty{
+		rl:       rl,
+		mu:       &sync.RWMutex{},
+		schedule: schedule,
+		decay:    decay,
+	}
+}
+
+// SetSchedule adjusts Penalty.schedule using a RWMutex to lock the struct for safe concurrent use
+func (p *Penalty) SetSchedule(schedule ...time.Duration) {
+	p.mu.Lock()
+	p.schedule = schedule
+	p.mu.Unlock()
+}
+
+// SetDecay adjusts Penalty.decay using a RWMutex to lock the struct for safe concurrent use
+func (p *Penalty) SetDecay(decay time.Duration) {
+	p.mu.Lock()
+	p.decay = decay
+	p.mu.Unlock()
+}
+
+// Allow is shorthand for AllowN(key, 1)
+func (p *Penalty) Allow(key string) (Result, error) {
+	return p.AllowNContext(context.Background(), key, 1)
+}
+
+// AllowContext is shorthand for AllowNContext(ctx, key, 1)
+func (p *Penalty) AllowContext(ctx context.Context, key string) (Result, error) {
+	return p.AllowNContext(ctx, key, 1)
+}
+
+// AllowN is shorthand for AllowNContext(context.Background(), key, n)
+func (p *Penalty) AllowN(key string, n int64) (Result, error) {
+	return p.AllowNContext(context.Background(), key, n)
+}
+
+// AllowNContext rejects the request with Result.LockedUntil set while key is locked out, and otherwise spends n
+// tokens with RateLimit.AllowNContext(). When the RateLimit rejects the request a violation is recorded, and if it
+// starts a lockout Result.LockedUntil is set and Result.RetryAfter covers the lockout
+func (p *Penalty) AllowNContext(ctx context.Context, key string, n int64) (Result, error) {
+	p.mu.RLock()
+	schedule := p.schedule
+	decay := p.decay
+	p.mu.RUnlock()
+
+	cfg, err := p.rl.configFor(ctx, key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// keys matching an allow or deny Rule are decided without the backend, a deny Rule is not a violation
+	if _, ok := cfg.matchRules(key); ok {
+		return p.rl.allowN(ctx, cfg, key, n, PriorityInteractive)
+	}
+
+	// a penalty that cannot be read is no penalty when the FailurePolicy handles the failure
+	var violations, lastViolationNS int64
+	failure, err := cfg.guard(ctx, "get penalty", func(cfg config) (err error) {
+		violations, lastViolationNS, err = getState(ctx, cfg.backend, penaltyKey(key))
+		return err
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	if failure != nil && cfg.failurePolicy != FailLocal {
+		violations, lastViolationNS = 0, 0
+	}
+
+	currentTime := cfg.clock.Now().UnixNano()
+	if lockedUntil := lastViolationNS + int64(lockout(violations, schedule)); currentTime < lockedUntil {
+		// the RateLimit is not reached during a lockout so the rejection is reported to the observers here
+		result := Result{
+			Allowed:     false,
+			Limit:       cfg.burst,
+			RetryAfter:  time.Duration(lockedUntil - currentTime),
+			LockedUntil: time.Unix(0, lockedUntil),
+			Degraded:    failure != nil,
+		}
+		cfg.notify(Event{Key: key, Cost: n, Result: result, Err: failure})
+		return result, nil
+	}
+
+	result, err := p.rl.AllowNContext(ctx, key, n)
+	if err != nil || result.Allowed {
+		return result, err
+	}
+
+	violations, err = p.violate(ctx, cfg, key, currentTime, schedule, decay)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if duration := lockout(violations, schedule); duration > 0 {
+		result.LockedUntil = time.Unix(0, currentTime+int64(duration))
+		if duration > result.RetryAfter {
+			result.RetryAfter = duration
+		}
+	}
+
+	return result, nil
+}
+
+// Forgive removes every violation of key, lifting its lockout if it is locked out, for example when support
+// confirms the user was locked out by mistake. The bucket of key is left untouched, see RateLimit.Reset()
+func (p *Penalty) Forgive(key string) error {
+	return p.rl.Delete(penaltyKey(key))
+}
+
+// violate records a violation for key at currentTime after forgiving the violations that have decayed, and returns
+// the number of violations stored. The GetState()/SetState() round trip is serialized with the key locks of the
+// RateLimit, processes sharing a backend may occasionally lose a violation to a concurrent one. The round trip goes
+// through the FailurePolicy of the RateLimit like Allow() does
+func (p *Penalty) violate(ctx context.Context, cfg config, key string, currentTime int64, schedule []time.Duration, decay time.Duration) (int64, error) {
+	key = penaltyKey(key)
+
+	keyLock := p.rl.keyLocks.lock(key)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	var violations int64
+	failure, err := cfg.guard(ctx, "record penalty", func(cfg config) error {
+		previous, lastViolationNS, err := getState(ctx, cfg.backend, key)
+		if err != nil {
+			return err
+		}
+
+		violations = decayViolations(currentTime, previous, lastViolationNS, schedule, decay) + 1
+		return setState(ctx, cfg.backend, key, violations, currentTime)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// the violation is dropped when the FailurePolicy handles the failure
+	if failure != nil && cfg.failurePolicy != FailLocal {
+		return 0, nil
+	}
+
+	return violations, nil
+}
+
+// penaltyKey returns the key the violations of key are stored under
+func penaltyKey(key string) string {
+	return key + ":penalty"
+}
+
+// lockout returns the duration of the schedule that applies to the violations-th violation, the last duration
+// applies to every violation beyond the length of the schedule
+func lockout(violations int64, schedule []time.Duration) time.Duration {
+	if violations < 1 || len(schedule) == 0 {
+		return 0
+	}
+
+	if violations > int64(len(schedule)) {
+		return schedule[len(schedule)-1]
+	}
+
+	return schedule[violations-1]
+}
+
+// decayViolations returns the number of violations left once one has been forgiven for every decay that has passed
+// since the lockout of the last violation ended
+func decayViolations(currentTime, violations, lastViolationNS int64, schedule []time.Duration, decay time.Duration) int64 {
+	if violations < 1 || decay <= 0 {
+		return violations
+	}
+
+	cleanSince := lastViolationNS + int64(lockout(violations, schedule))
+	if currentTime <= cleanSince {
+		return violations
+	}
+
+	forgiven := (currentTime - cleanSince) / int64(decay)
+	if forgiven >= violations {
+		return 0
+	}
+
+	return violations - forgiven
+}
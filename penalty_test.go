@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+// exhaust spends the bucket at key with penalty until a request is rejected and returns that Result
+func exhaust(t *testing.T, penalty *Penalty, key string) Result {
+	for i := 0; i < 100; i++ {
+		result, err := penalty.Allow(key)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !result.Allowed {
+			return result
+		}
+	}
+
+	t.Fatal("the bucket was never exhausted")
+	return Result{}
+}
+
+func TestPenaltyEscalatesAndDecays(t *testing.T) {
+	limiter, clock := newTestLimiter(memory.New())
+	penalty := NewPenalty(limiter, time.Hour, time.Minute, 5*time.Minute, time.Hour)
+	key := "login"
+
+	// the first violation locks the key out for the first duration of the schedule
+	result := exhaust(t, penalty, key)
+	if want := clock.Now().Add(time.Minute); !result.LockedUntil.Equal(want) || result.RetryAfter != time.Minute {
+		t.Logf("first violation returned %+v, want LockedUntil %v", result, want)
+		t.Fail()
+	}
+
+	// requests during the lockout are rejected without escalating it
+	clock.Advance(30 * time.Second)
+	result, err := penalty.Allow(key)
+	if err != nil || result.Allowed || !result.LockedUntil.Equal(clock.Now().Add(30*time.Second)) || result.RetryAfter != 30*time.Second {
+		t.Logf("request during the lockout returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	// the bucket refills fully while the key is locked out so the second violation follows a full burst
+	clock.Advance(30 * time.Second)
+	result = exhaust(t, penalty, key)
+	if result.Remaining != 0 || !result.LockedUntil.Equal(clock.Now().Add(5*time.Minute)) {
+		t.Logf("second violation returned %+v", result)
+		t.Fail()
+	}
+
+	// an hour of clean behaviour after the lockout forgives one violation, so the next one is the second again
+	clock.Advance(5*time.Minute + time.Hour)
+	result = exhaust(t, penalty, key)
+	if !result.LockedUntil.Equal(clock.Now().Add(5 * time.Minute)) {
+		t.Logf("violation after decaying one returned %+v", result)
+		t.Fail()
+	}
+
+	// the last duration repeats beyond the schedule
+	for i := 0; i < 2; i++ {
+		clock.Set(result.LockedUntil)
+		result = exhaust(t, penalty, key)
+	}
+
+	if !result.LockedUntil.Equal(clock.Now().Add(time.Hour)) {
+		t.Logf("fourth violation returned %+v", result)
+		t.Fail()
+	}
+
+	// long enough clean behaviour forgives every violation
+	clock.Set(result.LockedUntil.Add(4 * time.Hour))
+	result = exhaust(t, penalty, key)
+	if !result.LockedUntil.Equal(clock.Now().Add(time.Minute)) {
+		t.Logf("violation after decaying every violation returned %+v", result)
+		t.Fail()
+	}
+}
+
+func TestPenaltyWithoutSchedule(t *testing.T) {
+	limiter, _ := newTestLimiter(memory.New())
+	penalty := NewPenalty(limiter, time.Hour)
+
+	result := exhaust(t, penalty, "signup")
+	if !result.LockedUntil.IsZero() || result.RetryAfter != defaultTestInterval {
+		t.Logf("violation without a schedule returned %+v", result)
+		t.Fail()
+	}
+}
+
+func TestPenaltyLockoutNotifiesObservers(t *testing.T) {
+	limiter, _ := newTestLimiter(memory.New())
+	observer := &recordingObserver{}
+	limiter.AddObserver(observer)
+	penalty := NewPenalty(limiter, time.Hour, time.Minute)
+	key := "login:observed"
+
+	exhaust(t, penalty, key)
+	denies := len(observer.denies)
+
+	// a request rejected by the lockout never reaches the RateLimit but is still reported
+	result, err := penalty.AllowN(key, 2)
+	if err != nil || result.LockedUntil.IsZero() {
+		t.Fatalf("request during the lockout returned %+v err %v", result, err)
+	}
+
+	if len(observer.denies) != denies+1 || len(observer.errors) != 0 {
+		t.Fatalf("the lockout reported %d denies and %d errors", len(observer.denies)-denies, len(observer.errors))
+	}
+
+	if event := observer.denies[denies]; event.Key != key || event.Cost != 2 || event.Result != result {
+		t.Logf("the lockout reported %+v, wanted the Result %+v", event, result)
+		t.Fail()
+	}
+}
+
+func TestPenaltyForgive(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, _ := newTestLimiter(backend)
+		penalty := NewPenalty(limiter, time.Hour, time.Minute, time.Hour)
+		key := "login:forgiven"
+
+		// resetting the bucket does not lift the lockout
+		exhaust(t, penalty, key)
+		if err := limiter.Reset(key); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if result, err := penalty.Allow(key); err != nil || result.LockedUntil.IsZero() {
+			t.Fatalf("(%s) request after Reset() returned %+v err %v", name, result, err)
+		}
+
+		if err := penalty.Forgive(key); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if result, err := penalty.Allow(key); err != nil || !result.Allowed {
+			t.Logf("(%s) request after Forgive() returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		// the next violation is the first one again
+		if err := limiter.SetAllowance(key, 0); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if result := exhaust(t, penalty, key); result.RetryAfter != time.Minute {
+			t.Logf("(%s) violation after Forgive() returned %+v", name, result)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoPolicy can be returned by a PolicyResolver when it has no Limit for a key, in which case the values
+// passed to New() are used
+var ErrNoPolicy = errors.New("ratelimit: no policy for key")
+
+// Limit is the rate, interval and burst applied to a key. Zero fields fall back to the values passed to New()
+// so a policy can override only the burst, for example
+type Limit struct {
+	Rate     int64
+	Interval time.Duration
+	Burst    int64
+}
+
+// PolicyResolver resolves the Limit of a key on every call to Allow(), for example Amy pays $5 and gets 5
+// requests per second while George pays $10 and gets 10 requests per second
+type PolicyResolver interface {
+	Resolve(ctx context.Context, key string) (Limit, error)
+}
+
+// PolicyResolverFunc adapts an ordinary function to the PolicyResolver interface
+type PolicyResolverFunc func(ctx context.Context, key string) (Limit, error)
+
+// Resolve calls f(ctx, key)
+func (f PolicyResolverFunc) Resolve(ctx context.Context, key string) (Limit, error) {
+	return f(ctx, key)
+}
+
+// CachedPolicyResolver caches the Limit resolved for each key for a ttl so that a PolicyResolver backed by a
+// database does not add a round trip to every Allow(). ErrNoPolicy is cached as well, any other error is not
+type CachedPolicyResolver struct {
+	resolver PolicyResolver
+	ttl      time.Duration
+	// mu protects clock, entries and lastSweep
+	mu      *sync.RWMutex
+	clock   Clock
+	entries map[string]cachedPolicy
+	// lastSweep is when expired entries were last removed from entries, the zero time.Time before the first sweep
+	lastSweep time.Time
+}
+
+type cachedPolicy struct {
+	limit   Limit
+	err     error
+	expires time.Time
+}
+
+// NewCachedPolicyResolver returns a new instance of CachedPolicyResolver wrapping resolver
+func NewCachedPolicyResolver(resolver PolicyResolver, ttl time.Duration) *CachedPolicyResolver {
+	return &CachedPolicyResolver{
+		resolver: resolver,
+		ttl:      ttl,
+		mu:       &sync.RWMutex{},
+		clock:    newSystemClock(),
+		entries:  make(map[string]cachedPolicy),
+	}
+}
+
+// SetClock adjusts CachedPolicyResolver.clock using a RWMutex to lock the struct for safe concurrent use
+func (c *CachedPolicyResolver) SetClock(clock Clock) {
+	c.mu.Lock()
+	c.clock = clock
+	c.mu.Unlock()
+}
+
+// Resolve returns the cached Limit for key or resolves and caches it if it is missing or expired
+func (c *CachedPolicyResolver) Resolve(ctx context.Context, key string) (Limit, error) {
+	c.mu.RLock()
+	now := c.clock.Now()
+	entry, exists := c.entries[key]
+	c.mu.RUnlock()
+	if exists && now.Before(entry.expires) {
+		return entry.limit, entry.err
+	}
+
+	limit, err := c.resolver.Resolve(ctx, key)
+	if err != nil && !errors.Is(err, ErrNoPolicy) {
+		return Limit{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// remove expired entries at most once per ttl so keys that are no longer used don't accumulate
+	if now.Sub(c.lastSweep) >= c.ttl {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	c.entries[key] = cachedPolicy{limit: limit, err: err, expires: now.Add(c.ttl)}
+	return limit, err
+}
+
+// Invalidate removes the cached Limit for key so the next Resolve() calls the wrapped PolicyResolver, for example
+// after a customer changes plan
+func (c *CachedPolicyResolver) Invalidate(key string) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
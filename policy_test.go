@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+	"github.com/beeekind/ratelimit/ratelimittest"
+)
+
+var plans = PolicyResolverFunc(func(ctx context.Context, key string) (Limit, error) {
+	switch key {
+	case "amy":
+		return Limit{Rate: 5, Interval: time.Second, Burst: 5}, nil
+	case "george":
+		return Limit{Burst: 20}, nil
+	case "broken":
+		return Limit{}, errors.New("database unavailable")
+	}
+
+	return Limit{}, ErrNoPolicy
+})
+
+func TestPolicyResolver(t *testing.T) {
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, memory.New())
+	limiter.SetPolicyResolver(plans)
+
+	expectedLimits := map[string]int64{
+		"amy":    5,
+		"george": 20,
+		// keys without a policy fall back to the values passed to New()
+		"benjamin": defaultTestBurst,
+	}
+
+	for key, expectedLimit := range expectedLimits {
+		result, err := limiter.Allow(key)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if result.Limit != expectedLimit || result.Remaining != expectedLimit-1 {
+			t.Logf("key %s returned %+v, expected a limit of %v", key, result, expectedLimit)
+			t.Fail()
+		}
+	}
+
+	if _, err := limiter.Allow("broken"); err == nil {
+		t.Log("a failing PolicyResolver did not return an error")
+		t.Fail()
+	}
+}
+
+func TestCachedPolicyResolver(t *testing.T) {
+	calls := int64(0)
+	counting := PolicyResolverFunc(func(ctx context.Context, key string) (Limit, error) {
+		atomic.AddInt64(&calls, 1)
+		return plans(ctx, key)
+	})
+
+	cached := NewCachedPolicyResolver(counting, time.Minute)
+	for _, key := range []string{"amy", "amy", "benjamin", "benjamin"} {
+		if _, err := cached.Resolve(context.Background(), key); err != nil && !errors.Is(err, ErrNoPolicy) {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if calls != 2 {
+		t.Logf("wrapped resolver called %v times, expected once per key", calls)
+		t.Fail()
+	}
+
+	cached.Invalidate("amy")
+	if _, err := cached.Resolve(context.Background(), "amy"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if calls != 3 {
+		t.Logf("wrapped resolver called %v times after Invalidate, expected 3", calls)
+		t.Fail()
+	}
+
+	// errors other than ErrNoPolicy are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := cached.Resolve(context.Background(), "broken"); err == nil {
+			t.Fatal("a failing PolicyResolver did not return an error")
+		}
+	}
+
+	if calls != 5 {
+		t.Logf("wrapped resolver called %v times for a failing key, expected 5", calls)
+		t.Fail()
+	}
+}
+
+func TestCachedPolicyResolverExpires(t *testing.T) {
+	calls := int64(0)
+	counting := PolicyResolverFunc(func(ctx context.Context, key string) (Limit, error) {
+		atomic.AddInt64(&calls, 1)
+		return plans(ctx, key)
+	})
+
+	clock := ratelimittest.NewClock(tNow)
+	cached := NewCachedPolicyResolver(counting, time.Minute)
+	cached.SetClock(clock)
+
+	resolve := func() {
+		if _, err := cached.Resolve(context.Background(), "amy"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	resolve()
+	clock.Advance(time.Minute - time.Nanosecond)
+	resolve()
+	if calls != 1 {
+		t.Logf("wrapped resolver called %v times within the ttl, expected once", calls)
+		t.Fail()
+	}
+
+	clock.Advance(time.Nanosecond)
+	resolve()
+	if calls != 2 {
+		t.Logf("wrapped resolver called %v times once the ttl passed, expected 2", calls)
+		t.Fail()
+	}
+}
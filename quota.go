@@ -0,0 +1,241 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Period is the calendar unit a Quota resets on
+type Period int
+
+const (
+	// Hour resets a Quota at the start of every hour
+	Hour Period = iota + 1
+	// Day resets a Quota at midnight
+	Day
+	// Week resets a Quota at midnight between Sunday and Monday
+	Week
+	// Month resets a Quota at midnight on the 1st
+	Month
+)
+
+// String implements fmt.Stringer
+func (p Period) String() string {
+	switch p {
+	case Hour:
+		return "hour"
+	case Day:
+		return "day"
+	case Week:
+		return "week"
+	case Month:
+		return "month"
+	default:
+		return fmt.Sprintf("Period(%d)", int(p))
+	}
+}
+
+// start returns the start of the period containing t, in the location of t
+func (p Period) start(t time.Time) time.Time {
+	year, month, day := t.Date()
+	switch p {
+	case Hour:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, t.Location())
+	case Day:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	case Week:
+		// time.Sunday is 0, weeks start on Monday
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-daysSinceMonday, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// next returns the start of the period following the one starting at start
+func (p Period) next(start time.Time) time.Time {
+	year, month, day := start.Date()
+	switch p {
+	case Hour:
+		return time.Date(year, month, day, start.Hour()+1, 0, 0, 0, start.Location())
+	case Day:
+		return time.Date(year, month, day+1, 0, 0, 0, 0, start.Location())
+	case Week:
+		return time.Date(year, month, day+7, 0, 0, 0, 0, start.Location())
+	default:
+		return time.Date(year, month+1, 1, 0, 0, 0, 0, start.Location())
+	}
+}
+
+// Quota allows limit tokens per calendar period, for example 50,000 calls per month resetting at midnight UTC on the
+// 1st, or 1,000 per day in the timezone of a customer. Unlike RateLimit nothing is refilled during the period, the
+// whole limit becomes available again at the start of the next one.
+//
+// The state of a key is stored in the Backend as the tokens remaining and the start of the period they belong to, so
+// a Quota works on every backend and with the same atomicity as RateLimit: the period start is handed to the backend
+// as the current time and a bucket whose timestamp belongs to an earlier period is refilled to limit
+type Quota struct {
+	// mu protects limit, period, location, backend and clock from concurrent Set calls
+	mu       *sync.RWMutex
+	limit    int64
+	period   Period
+	location *time.Location
+	backend  Backend
+	clock    Clock
+	// keyLocks serializes the GetState()/SetState() round trip per key for backends without AtomicBackend
+	keyLocks stripedMutex
+}
+
+// NewQuota returns a new instance of Quota allowing limit tokens per period, aligned to the calendar of location.
+// A nil location is time.UTC
+func NewQuota(limit int64, period Period, location *time.Location, backend Backend) *Quota {
+	return &Quota{
+		mu:       &sync.RWMutex{},
+		limit:    limit,
+		period:   period,
+		location: location,
+		backend:  backend,
+		clock:    newSystemClock(),
+		keyLocks: newStripedMutex(defaultLockStripes),
+	}
+}
+
+// SetLimit adjusts Quota.limit using a RWMutex to lock the struct for safe concurrent use
+func (q *Quota) SetLimit(limit int64) {
+	q.mu.Lock()
+	q.limit = limit
+	q.mu.Unlock()
+}
+
+// SetPeriod adjusts Quota.period using a RWMutex to lock the struct for safe concurrent use
+func (q *Quota) SetPeriod(period Period) {
+	q.mu.Lock()
+	q.period = period
+	q.mu.Unlock()
+}
+
+// SetLocation adjusts Quota.location using a RWMutex to lock the struct for safe concurrent use
+func (q *Quota) SetLocation(location *time.Location) {
+	q.mu.Lock()
+	q.location = location
+	q.mu.Unlock()
+}
+
+// SetBackend adjusts Quota.backend using a RWMutex to lock the struct for safe concurrent use
+func (q *Quota) SetBackend(backend Backend) {
+	q.mu.Lock()
+	q.backend = backend
+	q.mu.Unlock()
+}
+
+// SetClock adjusts Quota.clock using a RWMutex to lock the struct for safe concurrent use
+func (q *Quota) SetClock(clock Clock) {
+	q.mu.Lock()
+	q.clock = clock
+	q.mu.Unlock()
+}
+
+// quotaConfig is a snapshot of the Quota configuration
+type quotaConfig struct {
+	limit    int64
+	period   Period
+	location *time.Location
+	backend  Backend
+	clock    Clock
+}
+
+// config returns a snapshot of the Quota configuration taken under a read lock
+func (q *Quota) config() (quotaConfig, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.limit < 1 || q.period < Hour || q.period > Month {
+		return quotaConfig{}, fmt.Errorf("%w: quota limit %d must be positive and period %v must be valid", ErrInvalidConfig, q.limit, q.period)
+	}
+
+	location := q.location
+	if location == nil {
+		location = time.UTC
+	}
+
+	return quotaConfig{limit: q.limit, period: q.period, location: location, backend: q.backend, clock: q.clock}, nil
+}
+
+// NextReset returns the time at which the current period ends and every key has its full limit again
+func (q *Quota) NextReset() (time.Time, error) {
+	c, err := q.config()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return c.period.next(c.period.start(c.clock.Now().In(c.location))), nil
+}
+
+// Allow is shorthand for AllowN(key, 1)
+func (q *Quota) Allow(key string) (Result, error) {
+	return q.AllowNContext(context.Background(), key, 1)
+}
+
+// AllowContext is shorthand for AllowNContext(ctx, key, 1)
+func (q *Quota) AllowContext(ctx context.Context, key string) (Result, error) {
+	return q.AllowNContext(ctx, key, 1)
+}
+
+// AllowN is shorthand for AllowNContext(context.Background(), key, n)
+func (q *Quota) AllowN(key string, n int64) (Result, error) {
+	return q.AllowNContext(context.Background(), key, n)
+}
+
+// AllowNContext spends n tokens from the quota of key for the current period, or spends none if fewer than n are
+// left. Result.Limit is the limit per period, Result.ResetAfter is the time.Duration until the next period starts
+// (zero if nothing has been spent) and Result.RetryAfter is the same duration when the request is rejected
+func (q *Quota) AllowNContext(ctx context.Context, key string, n int64) (Result, error) {
+	c, err := q.config()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if n < 1 {
+		return Result{}, fmt.Errorf("failed to allowN: n must be positive, got %d", n)
+	}
+
+	if n > c.limit {
+		return Result{}, fmt.Errorf("failed to allowN: %w (%d > %d)", ErrExceedsBurst, n, c.limit)
+	}
+
+	now := c.clock.Now().In(c.location)
+	start := c.period.start(now)
+	untilReset := c.period.next(start).Sub(now)
+
+	// with an interval of 1ns any earlier period start refills the bucket to limit, while the same period start
+	// refills nothing
+	cfg := config{
+		burst:    c.limit,
+		rate:     c.limit,
+		interval: time.Nanosecond,
+		backend:  c.backend,
+	}
+
+	allowed, remaining, _, err := take(ctx, q.keyLocks, cfg, key, n, 0, start.UnixNano())
+	if err != nil {
+		return Result{}, wrapBackendError("allowN", err)
+	}
+
+	result := Result{
+		Allowed:   allowed,
+		Limit:     c.limit,
+		Remaining: remaining,
+	}
+
+	if !allowed {
+		result.RetryAfter = untilReset
+	}
+
+	if remaining < c.limit {
+		result.ResetAfter = untilReset
+	}
+
+	return result, nil
+}
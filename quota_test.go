@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+	"github.com/beeekind/ratelimit/ratelimittest"
+)
+
+func TestPeriodStart(t *testing.T) {
+	india := time.FixedZone("IST", 5*3600+1800)
+	// 2021-03-03 is a Wednesday
+	now := time.Date(2021, time.March, 3, 14, 45, 30, 0, india)
+
+	tests := []struct {
+		period Period
+		start  time.Time
+		next   time.Time
+	}{
+		{Hour, time.Date(2021, time.March, 3, 14, 0, 0, 0, india), time.Date(2021, time.March, 3, 15, 0, 0, 0, india)},
+		{Day, time.Date(2021, time.March, 3, 0, 0, 0, 0, india), time.Date(2021, time.March, 4, 0, 0, 0, 0, india)},
+		{Week, time.Date(2021, time.March, 1, 0, 0, 0, 0, india), time.Date(2021, time.March, 8, 0, 0, 0, 0, india)},
+		{Month, time.Date(2021, time.March, 1, 0, 0, 0, 0, india), time.Date(2021, time.April, 1, 0, 0, 0, 0, india)},
+	}
+
+	for _, test := range tests {
+		start := test.period.start(now)
+		if !start.Equal(test.start) {
+			t.Logf("(%v) start %v != %v", test.period, start, test.start)
+			t.Fail()
+		}
+
+		if next := test.period.next(start); !next.Equal(test.next) {
+			t.Logf("(%v) next %v != %v", test.period, next, test.next)
+			t.Fail()
+		}
+	}
+
+	// a sunday belongs to the week that started on the previous monday
+	sunday := time.Date(2021, time.March, 7, 23, 0, 0, 0, time.UTC)
+	if start := Week.start(sunday); !start.Equal(time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Logf("week of a sunday starts %v", start)
+		t.Fail()
+	}
+}
+
+func TestQuotaResetsAtCalendarBoundary(t *testing.T) {
+	for name, backend := range testBackends() {
+		clock := ratelimittest.NewClock(time.Date(2021, time.January, 31, 23, 0, 0, 0, time.UTC))
+		quota := NewQuota(3, Month, nil, backend)
+		quota.SetClock(clock)
+		key := "monthly"
+
+		for i := 0; i < 3; i++ {
+			if result, err := quota.Allow(key); err != nil || !result.Allowed || result.Remaining != int64(2-i) {
+				t.Logf("(%s) Allow() #%v returned %+v err %v", name, i, result, err)
+				t.Fail()
+			}
+		}
+
+		// nothing refills during the period
+		clock.Advance(59 * time.Minute)
+		result, err := quota.Allow(key)
+		if err != nil || result.Allowed || result.RetryAfter != time.Minute || result.ResetAfter != time.Minute {
+			t.Logf("(%s) Allow() over quota returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		if reset, _ := quota.NextReset(); !reset.Equal(time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Logf("(%s) NextReset() %v", name, reset)
+			t.Fail()
+		}
+
+		// the whole quota is available again on the 1st
+		clock.Advance(time.Minute)
+		result, err = quota.AllowN(key, 3)
+		if err != nil || !result.Allowed || result.Remaining != 0 {
+			t.Logf("(%s) AllowN(3) in the next period returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestQuotaInLocation(t *testing.T) {
+	newYork := time.FixedZone("EST", -5*3600)
+	// 2021-03-03 04:30 UTC is still 2021-03-02 in new york
+	clock := ratelimittest.NewClock(time.Date(2021, time.March, 3, 4, 30, 0, 0, time.UTC))
+	quota := NewQuota(1, Day, newYork, memory.New())
+	quota.SetClock(clock)
+
+	if result, _ := quota.Allow("daily"); !result.Allowed {
+		t.Log("first Allow() was rejected")
+		t.Fail()
+	}
+
+	result, _ := quota.Allow("daily")
+	if result.Allowed || result.RetryAfter != 30*time.Minute {
+		t.Logf("Allow() over a daily quota in new york returned %+v", result)
+		t.Fail()
+	}
+}
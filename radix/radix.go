@@ -14,10 +14,14 @@ package radix
 // and strconv.FormatInt(val, 10).
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/beeekind/ratelimit"
+	"github.com/beeekind/ratelimit/internal/script"
 	"github.com/mediocregopher/radix/v3"
 )
 
@@ -30,6 +34,12 @@ type Backend struct {
 const allowanceKey = "0"
 const accessedKey = "1"
 
+// takeScript refills and spends a bucket stored as a hash set in one round trip
+var takeScript = radix.NewEvalScript(1, script.Take)
+
+// acquireLeaseScript adds a lease to a sorted set scored by expiry unless the limit of unexpired leases is reached
+var acquireLeaseScript = radix.NewEvalScript(1, script.AcquireLease)
+
 // New returns a new instance of radix.Backend
 func New(pool *radix.Pool) *Backend {
 	return &Backend{
@@ -37,42 +47,191 @@ func New(pool *radix.Pool) *Backend {
 	}
 }
 
-// SetState ...
+// do performs action on the pool and returns ctx.Err() as soon as ctx is done. radix/v3 cannot cancel an action
+// that has been sent, so it completes in the background and its result is discarded
+func (b *Backend) do(ctx context.Context, action radix.Action) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// context.Background() and context.TODO() can never be done
+	if ctx.Done() == nil {
+		return b.pool.Do(action)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- b.pool.Do(action)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetState is shorthand for SetStateContext(context.Background(), key, allowance, lastAccessedTimestampNS)
 func (b *Backend) SetState(key string, allowance int64, lastAccessedTimestampNS int64) error {
+	return b.SetStateContext(context.Background(), key, allowance, lastAccessedTimestampNS)
+}
+
+// SetStateContext implements ratelimit.ContextBackend, note that a write abandoned when ctx is done may still be
+// applied
+func (b *Backend) SetStateContext(ctx context.Context, key string, allowance int64, lastAccessedTimestampNS int64) error {
 	var result string
-	if err := b.pool.Do(radix.Cmd(&result, "HSET", key, allowanceKey, strconv.FormatInt(allowance, 10), accessedKey, strconv.FormatInt(lastAccessedTimestampNS, 10))); err != nil {
+	if err := b.do(ctx, radix.Cmd(&result, "HSET", key, allowanceKey, strconv.FormatInt(allowance, 10), accessedKey, strconv.FormatInt(lastAccessedTimestampNS, 10))); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// GetState ...
+// GetState is shorthand for GetStateContext(context.Background(), key)
 func (b *Backend) GetState(key string) (allowance int64, lastAllowedTimeStampNS int64, err error) {
+	return b.GetStateContext(context.Background(), key)
+}
+
+// GetStateContext implements ratelimit.ContextBackend
+func (b *Backend) GetStateContext(ctx context.Context, key string) (allowance int64, lastAllowedTimeStampNS int64, err error) {
 	var hashSet map[string]string
-	if err := b.pool.Do(radix.Cmd(&hashSet, "HGETALL", key)); err != nil {
+	if err := b.do(ctx, radix.Cmd(&hashSet, "HGETALL", key)); err != nil {
 		return 0, 0, fmt.Errorf("failed to getState: %w", err)
 	}
 
+	// non-existent keys represent the first time Allow() is called for a given key and return zero values
+	// which will be handled properly in beeekind/ratelimit, the same as beeekind/ratelimit/redigo
+	if len(hashSet) == 0 {
+		return 0, 0, nil
+	}
+
 	allowanceStr, allowanceExists := hashSet[allowanceKey]
 	lastAllowedTimeStampNSStr, lastAllowedTimeStampNSExists := hashSet[accessedKey]
-	if allowanceExists || lastAllowedTimeStampNSExists {
-		return 0, 0, errors.New("failed to getState: hashSet did not contain key")
+	if !allowanceExists || !lastAllowedTimeStampNSExists {
+		return 0, 0, fmt.Errorf("failed to getState: %w: %s hashSet did not contain key", ratelimit.ErrCorruptState, key)
 	}
 
 	allowance, err = strconv.ParseInt(allowanceStr, 10, 64)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to getState: value could not be parsed into int64: %w", err)
+		return 0, 0, fmt.Errorf("failed to getState: %w: value could not be parsed into int64: %v", ratelimit.ErrCorruptState, err)
 	}
 
 	lastAllowedTimeStampNS, err = strconv.ParseInt(lastAllowedTimeStampNSStr, 10, 64)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to getState: value could not be parsed into int64: %w", err)
+		return 0, 0, fmt.Errorf("failed to getState: %w: value could not be parsed into int64: %v", ratelimit.ErrCorruptState, err)
 	}
 
 	return allowance, lastAllowedTimeStampNS, err
 }
 
+// Delete implements ratelimit.Deleter by deleting the hash set at key
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	if err := b.do(ctx, radix.Cmd(nil, "DEL", key)); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+
+	return nil
+}
+
+// Take implements ratelimit.AtomicBackend by refilling and spending the hash set at key with a lua script so
+// that concurrent callers sharing the same redis cannot read the same allowance
+func (b *Backend) Take(ctx context.Context, key string, cost, floor, rate, interval, burst, now int64) (allowed bool, allowance int64, lastAccessedTimestampNS int64, err error) {
+	var reply []string
+	if err := b.do(ctx, takeScript.FlatCmd(&reply, []string{key}, cost, rate, interval, burst, now, floor)); err != nil {
+		return false, 0, 0, scriptError("take", err)
+	}
+
+	if len(reply) != 3 {
+		return false, 0, 0, fmt.Errorf("failed to take: %w: unexpected reply length %d", ratelimit.ErrCorruptState, len(reply))
+	}
+
+	allowance, err = strconv.ParseInt(reply[1], 10, 64)
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("failed to take: %w: value could not be parsed into int64: %v", ratelimit.ErrCorruptState, err)
+	}
+
+	lastAccessedTimestampNS, err = strconv.ParseInt(reply[2], 10, 64)
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("failed to take: %w: value could not be parsed into int64: %v", ratelimit.ErrCorruptState, err)
+	}
+
+	return reply[0] == "1", allowance, lastAccessedTimestampNS, nil
+}
+
+// TakeAll implements ratelimit.MultiBackend by refilling every hash set in keys and spending from them in a single
+// script, so the keys must hash to the same slot on a redis cluster
+func (b *Backend) TakeAll(ctx context.Context, keys []string, cost int64, limits []ratelimit.Limit, atomic bool, now int64) (allowed []bool, allowances []int64, lastAccessedTimestampsNS []int64, err error) {
+	args := make([]interface{}, 0, 3+3*len(limits))
+	args = append(args, cost, now, atomic)
+	for _, limit := range limits {
+		args = append(args, limit.Rate, int64(limit.Interval), limit.Burst)
+	}
+
+	// radix.EvalScript has a fixed number of keys so one is built per call
+	var reply []string
+	if err := b.do(ctx, radix.NewEvalScript(len(keys), script.TakeAll).FlatCmd(&reply, keys, args...)); err != nil {
+		return nil, nil, nil, scriptError("takeAll", err)
+	}
+
+	if len(reply) != 3*len(keys) {
+		return nil, nil, nil, fmt.Errorf("failed to takeAll: %w: unexpected reply length %d", ratelimit.ErrCorruptState, len(reply))
+	}
+
+	allowed = make([]bool, len(keys))
+	allowances = make([]int64, len(keys))
+	lastAccessedTimestampsNS = make([]int64, len(keys))
+	for i := range keys {
+		allowed[i] = reply[3*i] == "1"
+
+		allowances[i], err = strconv.ParseInt(reply[3*i+1], 10, 64)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to takeAll: %w: value could not be parsed into int64: %v", ratelimit.ErrCorruptState, err)
+		}
+
+		lastAccessedTimestampsNS[i], err = strconv.ParseInt(reply[3*i+2], 10, 64)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to takeAll: %w: value could not be parsed into int64: %v", ratelimit.ErrCorruptState, err)
+		}
+	}
+
+	return allowed, allowances, lastAccessedTimestampsNS, nil
+}
+
+// AcquireLease implements ratelimit.LeaseBackend with a sorted set at key whose members are lease ids scored by
+// their expiry in milliseconds, the precision a redis score can hold
+func (b *Backend) AcquireLease(ctx context.Context, key, id string, limit, expires, now int64) (acquired bool, held int64, err error) {
+	var reply []int64
+	if err := b.do(ctx, acquireLeaseScript.FlatCmd(&reply, []string{key}, id, limit, expires/int64(time.Millisecond), now/int64(time.Millisecond))); err != nil {
+		return false, 0, fmt.Errorf("failed to acquireLease: %w", err)
+	}
+
+	if len(reply) != 2 {
+		return false, 0, fmt.Errorf("failed to acquireLease: unexpected reply length %d", len(reply))
+	}
+
+	return reply[0] == 1, reply[1], nil
+}
+
+// ReleaseLease implements ratelimit.LeaseBackend by removing id from the sorted set at key
+func (b *Backend) ReleaseLease(ctx context.Context, key, id string) error {
+	if err := b.do(ctx, radix.Cmd(nil, "ZREM", key, id)); err != nil {
+		return fmt.Errorf("failed to releaseLease: %w", err)
+	}
+
+	return nil
+}
+
+// scriptError wraps an error returned by a lua script, mapping the script.CorruptStateError reply to
+// ratelimit.ErrCorruptState
+func scriptError(op string, err error) error {
+	if strings.HasPrefix(err.Error(), script.CorruptStateError) {
+		return fmt.Errorf("failed to %s: %w: %v", op, ratelimit.ErrCorruptState, err)
+	}
+
+	return fmt.Errorf("failed to %s: %w", op, err)
+}
+
 // FlushAll ...
 func (b *Backend) FlushAll() (string, error) {
 	var keysFlushed string
@@ -1,9 +1,14 @@
 package radix
 
 import (
+	"context"
+	"errors"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/beeekind/ratelimit"
+	"github.com/beeekind/ratelimit/ratelimittest"
 	"github.com/mediocregopher/radix/v3"
 )
 
@@ -16,6 +21,334 @@ func ConnectionFunction(network, addr string) (radix.Conn, error) {
 	return radix.Dial(network, addr, radix.DialAuthPass("password"), radix.DialSelectDB(0))
 }
 
+func TestGetState(t *testing.T) {
+	key := "state"
+	if _, err := backendOne.FlushAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	allowance, ts, err := backendOne.GetState(key)
+	if err != nil || allowance != 0 || ts != 0 {
+		t.Logf("missing key returned allowance %v ts %v err %v", allowance, ts, err)
+		t.Fail()
+	}
+
+	now := time.Now().UnixNano()
+	if err := backendOne.SetState(key, 5, now); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	allowance, ts, err = backendOne.GetState(key)
+	if err != nil || allowance != 5 || ts != now {
+		t.Logf("stored key returned allowance %v ts %v err %v", allowance, ts, err)
+		t.Fail()
+	}
+}
+
+func TestTake(t *testing.T) {
+	key := "take"
+	burst := int64(3)
+	interval := int64(time.Second)
+	now := time.Now().UnixNano()
+	if _, err := backendOne.FlushAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := int64(1); i <= burst; i++ {
+		allowed, allowance, ts, err := backendOne.Take(context.Background(), key, 1, 0, 1, interval, burst, now)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !allowed || allowance != burst-i || ts != now {
+			t.Logf("take %v returned allowed %v allowance %v ts %v", i, allowed, allowance, ts)
+			t.Fail()
+		}
+	}
+
+	allowed, allowance, _, err := backendOne.Take(context.Background(), key, 1, 0, 1, interval, burst, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if allowed || allowance != 0 {
+		t.Logf("empty bucket returned allowed %v allowance %v", allowed, allowance)
+		t.Fail()
+	}
+
+	allowed, allowance, ts, err := backendOne.Take(context.Background(), key, 1, 0, 1, interval, burst, now+interval)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !allowed || allowance != 0 || ts != now+interval {
+		t.Logf("refilled bucket returned allowed %v allowance %v ts %v", allowed, allowance, ts)
+		t.Fail()
+	}
+
+	// 1.5 intervals later one token is refilled and the half interval is kept towards the next refill
+	allowed, allowance, ts, err = backendOne.Take(context.Background(), key, 1, 0, 1, interval, burst, now+interval*5/2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !allowed || allowance != 0 || ts != now+2*interval {
+		t.Logf("partially refilled bucket returned allowed %v allowance %v ts %v", allowed, allowance, ts)
+		t.Fail()
+	}
+
+	// a negative cost returns tokens without filling the bucket beyond burst
+	allowed, allowance, _, err = backendOne.Take(context.Background(), key, -(burst + 1), 0, 1, interval, burst, now+interval*5/2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !allowed || allowance != burst {
+		t.Logf("returning tokens returned allowed %v allowance %v", allowed, allowance)
+		t.Fail()
+	}
+}
+
+func TestTakeFloor(t *testing.T) {
+	key := "floor"
+	if err := backendOne.Delete(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Now().UnixNano()
+	interval := int64(time.Second)
+	allowed, allowance, _, err := backendOne.Take(context.Background(), key, 8, 2, 1, interval, 10, now)
+	if err != nil || !allowed || allowance != 2 {
+		t.Logf("Take down to the floor returned allowed %v allowance %v err %v", allowed, allowance, err)
+		t.Fail()
+	}
+
+	allowed, allowance, _, err = backendOne.Take(context.Background(), key, 1, 2, 1, interval, 10, now)
+	if err != nil || allowed || allowance != 2 {
+		t.Logf("Take below the floor returned allowed %v allowance %v err %v", allowed, allowance, err)
+		t.Fail()
+	}
+
+	allowed, allowance, _, err = backendOne.Take(context.Background(), key, 2, 0, 1, interval, 10, now)
+	if err != nil || !allowed || allowance != 0 {
+		t.Logf("Take without a floor returned allowed %v allowance %v err %v", allowed, allowance, err)
+		t.Fail()
+	}
+}
+
+func TestTakeDebt(t *testing.T) {
+	key := "debt"
+	if err := backendOne.Delete(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Now().UnixNano()
+	interval := int64(time.Second)
+	allowed, allowance, _, err := backendOne.Take(context.Background(), key, 13, -5, 1, interval, 10, now)
+	if err != nil || !allowed || allowance != -3 {
+		t.Logf("Take into debt returned allowed %v allowance %v err %v", allowed, allowance, err)
+		t.Fail()
+	}
+
+	allowed, allowance, _, err = backendOne.Take(context.Background(), key, 3, -5, 1, interval, 10, now)
+	if err != nil || allowed || allowance != -3 {
+		t.Logf("Take beyond the debt limit returned allowed %v allowance %v err %v", allowed, allowance, err)
+		t.Fail()
+	}
+
+	// the debt is repaid by refills
+	allowance, lastAccessedTimestampNS, err := backendOne.GetState(key)
+	if err != nil || allowance != -3 || lastAccessedTimestampNS != now {
+		t.Logf("GetState in debt returned allowance %v lastAccessedTimestampNS %v err %v", allowance, lastAccessedTimestampNS, err)
+		t.Fail()
+	}
+
+	allowed, allowance, _, err = backendOne.Take(context.Background(), key, 1, 0, 1, interval, 10, now+4*interval)
+	if err != nil || !allowed || allowance != 0 {
+		t.Logf("Take after repaying the debt returned allowed %v allowance %v err %v", allowed, allowance, err)
+		t.Fail()
+	}
+}
+
+func TestCorruptState(t *testing.T) {
+	key := "corrupt"
+	if err := backendOne.pool.Do(radix.Cmd(nil, "HSET", key, allowanceKey, "five", accessedKey, "now")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, _, err := backendOne.GetState(key); !errors.Is(err, ratelimit.ErrCorruptState) {
+		t.Logf("GetState of a corrupt key returned err %v", err)
+		t.Fail()
+	}
+
+	if _, _, _, err := backendOne.Take(context.Background(), key, 1, 0, 1, int64(time.Second), 10, time.Now().UnixNano()); !errors.Is(err, ratelimit.ErrCorruptState) {
+		t.Logf("Take of a corrupt key returned err %v", err)
+		t.Fail()
+	}
+}
+
+func TestContext(t *testing.T) {
+	key := "context"
+	if err := backendOne.SetStateContext(context.Background(), key, 5, time.Now().UnixNano()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := backendOne.GetStateContext(cancelled, key); !errors.Is(err, context.Canceled) {
+		t.Logf("GetStateContext with a cancelled context returned err %v", err)
+		t.Fail()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	allowance, _, err := backendOne.GetStateContext(ctx, key)
+	if err != nil || allowance != 5 {
+		t.Logf("GetStateContext with a deadline returned allowance %v err %v", allowance, err)
+		t.Fail()
+	}
+}
+
+func TestDelete(t *testing.T) {
+	key := "delete"
+	if err := backendOne.SetState(key, 5, time.Now().UnixNano()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := backendOne.Delete(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	allowance, ts, err := backendOne.GetState(key)
+	if err != nil || allowance != 0 || ts != 0 {
+		t.Logf("GetState of a deleted key returned allowance %v ts %v err %v", allowance, ts, err)
+		t.Fail()
+	}
+
+	// deleting a key that does not exist is not an error
+	if err := backendOne.Delete(context.Background(), key); err != nil {
+		t.Logf("Delete of a missing key returned err %v", err)
+		t.Fail()
+	}
+}
+
+func TestQuota(t *testing.T) {
+	clock := ratelimittest.NewClock(time.Date(2021, time.January, 31, 23, 0, 0, 0, time.UTC))
+	quota := ratelimit.NewQuota(2, ratelimit.Month, time.UTC, backendOne)
+	quota.SetClock(clock)
+	key := "quota"
+	if err := backendOne.Delete(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i, want := range []bool{true, true, false} {
+		if result, err := quota.Allow(key); err != nil || result.Allowed != want {
+			t.Logf("Allow() #%v returned %+v err %v", i, result, err)
+			t.Fail()
+		}
+	}
+
+	clock.Advance(time.Hour)
+	if result, err := quota.AllowN(key, 2); err != nil || !result.Allowed {
+		t.Logf("AllowN(2) in the next period returned %+v err %v", result, err)
+		t.Fail()
+	}
+}
+
+func TestLease(t *testing.T) {
+	key := "leases"
+	if err := backendOne.Delete(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Now().UnixNano()
+	ttl := int64(time.Minute)
+	wantHeld := []int64{1, 2, 2}
+	for i, want := range []bool{true, true, false} {
+		acquired, held, err := backendOne.AcquireLease(context.Background(), key, strconv.Itoa(i), 2, now+ttl, now)
+		if err != nil || acquired != want || held != wantHeld[i] {
+			t.Logf("AcquireLease() #%v returned acquired %v held %v err %v", i, acquired, held, err)
+			t.Fail()
+		}
+	}
+
+	if err := backendOne.ReleaseLease(context.Background(), key, "0"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if acquired, _, err := backendOne.AcquireLease(context.Background(), key, "3", 2, now+ttl, now); err != nil || !acquired {
+		t.Logf("AcquireLease() after ReleaseLease() returned acquired %v err %v", acquired, err)
+		t.Fail()
+	}
+
+	// every lease has expired a ttl later
+	later := now + ttl
+	acquired, held, err := backendOne.AcquireLease(context.Background(), key, "4", 2, later+ttl, later)
+	if err != nil || !acquired || held != 1 {
+		t.Logf("AcquireLease() after the leases expired returned acquired %v held %v err %v", acquired, held, err)
+		t.Fail()
+	}
+}
+
+func TestTakeAll(t *testing.T) {
+	keys := []string{"takeAll:0", "takeAll:1"}
+	limits := []ratelimit.Limit{
+		{Rate: 1, Interval: time.Second, Burst: 2},
+		{Rate: 1, Interval: time.Hour, Burst: 1},
+	}
+	now := time.Now().UnixNano()
+
+	for _, key := range keys {
+		if err := backendOne.Delete(context.Background(), key); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	allowed, allowances, _, err := backendOne.TakeAll(context.Background(), keys, 1, limits, true, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !allowed[0] || !allowed[1] || allowances[0] != 1 || allowances[1] != 0 {
+		t.Logf("first TakeAll returned allowed %v allowances %v", allowed, allowances)
+		t.Fail()
+	}
+
+	// the second key is empty so the first key must not be charged
+	allowed, allowances, _, err = backendOne.TakeAll(context.Background(), keys, 1, limits, true, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !allowed[0] || allowed[1] || allowances[0] != 1 || allowances[1] != 0 {
+		t.Logf("second TakeAll returned allowed %v allowances %v", allowed, allowances)
+		t.Fail()
+	}
+
+	allowance, _, err := backendOne.GetState(keys[0])
+	if err != nil || allowance != 1 {
+		t.Logf("first key allowance %v err %v after a rejected TakeAll", allowance, err)
+		t.Fail()
+	}
+
+	// without atomic the first key is charged even though the second key is empty
+	allowed, allowances, _, err = backendOne.TakeAll(context.Background(), keys, 1, limits, false, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !allowed[0] || allowed[1] || allowances[0] != 0 || allowances[1] != 0 {
+		t.Logf("non-atomic TakeAll returned allowed %v allowances %v", allowed, allowances)
+		t.Fail()
+	}
+
+	allowance, _, err = backendOne.GetState(keys[0])
+	if err != nil || allowance != 0 {
+		t.Logf("first key allowance %v err %v after a non-atomic TakeAll", allowance, err)
+		t.Fail()
+	}
+}
+
 func BenchmarkSetState(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		err := backendOne.SetState(strconv.Itoa(i), 10, 10)
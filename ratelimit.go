@@ -1,15 +1,23 @@
 package ratelimit
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"sync"
 	"time"
+
+	"github.com/beeekind/ratelimit/memory"
 )
 
 // RateLimit ...
 type RateLimit struct {
 	// mu protects configuration changes in concurrent environments from interfering
-	// with the Allow() method
+	// with the Allow() method. Allow() only holds a read lock long enough to copy the configuration
 	mu *sync.RWMutex
+	// keyLocks serializes the GetState()/SetState() round trip per key without serializing unrelated keys
+	keyLocks stripedMutex
 	// burst represents the maximum "tokens" a given Key can refill to and the maximum amount of Allowed() calls
 	// that can return with a value of time.Duration(0) for any passage of (RateLimit.rate / RateLimit.burst) * RateLimit.interval
 	burst int64
@@ -19,16 +27,103 @@ type RateLimit struct {
 	interval time.Duration
 	// backend is an abstraction for storing the needed data for any given Key to be ratelimited
 	backend Backend
+	// resolver optionally overrides rate, interval, and burst per key, see PolicyResolver
+	resolver PolicyResolver
+	// clock provides the current time used to refill buckets, see Clock
+	clock Clock
+	// floors maps a Priority to the fraction of burst it cannot spend, see SetPriorityFloor()
+	floors map[Priority]float64
+	// waiters queues the goroutines in Wait() per key so they are served in arrival order
+	waiters *waitQueues
+	// maxWaiters is the number of goroutines that can wait on a key at once, unlimited if 0
+	maxWaiters int
+	// dryRun admits every request while still spending from and refilling buckets, see SetDryRun()
+	dryRun bool
+	// allowList and denyList match the keys that bypass the limit, see SetAllowList() and SetDenyList()
+	allowList *ruleList
+	denyList  *ruleList
+	// debtLimit is how far below zero Overdraft() can take the allowance of a key, see SetDebtLimit()
+	debtLimit int64
+	// observers are called on every decision and configuration change, see AddObserver()
+	observers []Observer
+	// failurePolicy decides requests while backend is unavailable, see SetFailurePolicy()
+	failurePolicy FailurePolicy
+	// breaker stops calling backend while it keeps failing, see SetCircuitBreaker()
+	breaker *circuitBreaker
+	// local is the backend FailLocal falls back to
+	local Backend
 }
 
 // Backend is an abstraction for storing the needed data for any given Key to be ratelimited
 type Backend interface {
 	// GetState returns an allowance representing the number of available tokens in the bucket and a lastAccessedTimestampNS representing
-	// the last time a key was evaluated to be refilled 
+	// the last time a key was evaluated to be refilled
 	GetState(key string) (allowance int64, lastAccessedTimestampNS int64, err error)
 	SetState(key string, allowance int64, lastAccessedTimestampNS int64) error
 }
 
+// ContextBackend is an optional interface a Backend can implement to bound GetState() and SetState() by the deadline
+// of a context.Context and to attach values such as trace spans to them. RateLimit.AllowContext() calls the
+// context aware methods when they are available and falls back to GetState() and SetState() otherwise
+type ContextBackend interface {
+	Backend
+	GetStateContext(ctx context.Context, key string) (allowance int64, lastAccessedTimestampNS int64, err error)
+	SetStateContext(ctx context.Context, key string, allowance int64, lastAccessedTimestampNS int64) error
+}
+
+// getState calls backend.GetStateContext() if backend implements ContextBackend, else backend.GetState()
+func getState(ctx context.Context, backend Backend, key string) (allowance int64, lastAccessedTimestampNS int64, err error) {
+	if contextBackend, ok := backend.(ContextBackend); ok {
+		return contextBackend.GetStateContext(ctx, key)
+	}
+
+	return backend.GetState(key)
+}
+
+// setState calls backend.SetStateContext() if backend implements ContextBackend, else backend.SetState()
+func setState(ctx context.Context, backend Backend, key string, allowance int64, lastAccessedTimestampNS int64) error {
+	if contextBackend, ok := backend.(ContextBackend); ok {
+		return contextBackend.SetStateContext(ctx, key, allowance, lastAccessedTimestampNS)
+	}
+
+	return backend.SetState(key, allowance, lastAccessedTimestampNS)
+}
+
+// AtomicBackend is an optional interface a Backend can implement to refill and spend a bucket in a single
+// operation. RateLimit.Allow() prefers Take() over the GetState()/SetState() round trip when it is available
+// so that several processes sharing a backend cannot spend the same token twice
+type AtomicBackend interface {
+	Backend
+	// Take refills the bucket at key as of now (in nanoseconds) and spends cost tokens from it if enough are
+	// available. A negative cost returns tokens to the bucket without filling it beyond burst. The returned
+	// allowance and lastAccessedTimestampNS represent the state stored after the call. Tokens are only spent if at
+	// least floor tokens are left afterwards, see RateLimit.SetPriorityFloor(). ctx bounds the call like it bounds
+	// ContextBackend
+	Take(ctx context.Context, key string, cost, floor, rate, interval, burst, now int64) (allowed bool, allowance int64, lastAccessedTimestampNS int64, err error)
+}
+
+// MultiBackend is an optional interface a Backend can implement to refill several buckets and spend from them in a
+// single operation, see Composite and RateLimit.AllowMulti()
+type MultiBackend interface {
+	Backend
+	// TakeAll refills the bucket at every key with the Limit at the same index as of now (in nanoseconds) and spends
+	// cost tokens from each bucket that has enough. If atomic is true tokens are spent from every bucket if all of
+	// them have enough, or from none of them, in which case the refilled state is not stored. allowed reports
+	// whether each bucket had enough tokens, and it is indexed like keys as are the returned allowances and
+	// lastAccessedTimestampsNS. ctx bounds the call like it bounds ContextBackend
+	TakeAll(ctx context.Context, keys []string, cost int64, limits []Limit, atomic bool, now int64) (allowed []bool, allowances []int64, lastAccessedTimestampsNS []int64, err error)
+}
+
+// UpdateBackend is an optional interface for in-process backends, such as memory.Backend, that can hold several keys
+// locked while RateLimit computes their new state. It gives the same guarantees as AtomicBackend and MultiBackend
+// without the backend having to implement the algorithm itself
+type UpdateBackend interface {
+	Backend
+	// Update calls fn with the state stored at every key (zero values for keys that don't exist) while holding them
+	// locked, and stores the states fn leaves in the slices if it returns true
+	Update(keys []string, fn func(allowances, lastAccessedTimestampsNS []int64) bool) error
+}
+
 // New returns a new instance of RateLimit
 func New(rate int64, interval time.Duration, burst int64, backend Backend) *RateLimit {
 	return &RateLimit{
@@ -36,121 +131,553 @@ func New(rate int64, interval time.Duration, burst int64, backend Backend) *Rate
 		rate:     rate,
 		interval: interval,
 		backend:  backend,
+		clock:    newSystemClock(),
 		mu:       &sync.RWMutex{},
+		keyLocks: newStripedMutex(defaultLockStripes),
+		waiters:  newWaitQueues(),
+		local:    memory.New(),
 	}
 }
 
-// SetBurst adjusts RateLimit.burst using a RWMutex to lock the struct for safe concurrent use
+// config is a snapshot of the RateLimit configuration so that calls to the backend don't hold RateLimit.mu
+type config struct {
+	burst      int64
+	rate       int64
+	interval   time.Duration
+	backend    Backend
+	resolver   PolicyResolver
+	clock      Clock
+	floors     map[Priority]float64
+	maxWaiters int
+	dryRun     bool
+	allowList  *ruleList
+	denyList   *ruleList
+	debtLimit  int64
+	observers  []Observer
+	// failurePolicy, breaker and local handle an unavailable backend, see guard()
+	failurePolicy FailurePolicy
+	breaker       *circuitBreaker
+	local         Backend
+}
+
+// validate returns an error wrapping ErrInvalidConfig if the configuration can never allow a request
+func (c config) validate() error {
+	if c.rate < 1 || c.interval <= 0 || c.burst < 1 {
+		return fmt.Errorf("%w: rate %d, interval %v and burst %d must all be positive", ErrInvalidConfig, c.rate, c.interval, c.burst)
+	}
+
+	for priority, floor := range c.floors {
+		if floor < 0 || floor >= 1 {
+			return fmt.Errorf("%w: floor %v of priority %d must be within [0, 1)", ErrInvalidConfig, floor, priority)
+		}
+	}
+
+	if c.debtLimit < 0 {
+		return fmt.Errorf("%w: debt limit %d must not be negative", ErrInvalidConfig, c.debtLimit)
+	}
+
+	return nil
+}
+
+// floor returns the number of tokens priority cannot spend, the fraction of burst set with SetPriorityFloor()
+// rounded up
+func (c config) floor(priority Priority) int64 {
+	return int64(math.Ceil(c.floors[priority] * float64(c.burst)))
+}
+
+// config returns a snapshot of the RateLimit configuration taken under a read lock
+func (rl *RateLimit) config() config {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return config{
+		burst:      rl.burst,
+		rate:       rl.rate,
+		interval:   rl.interval,
+		backend:    rl.backend,
+		resolver:   rl.resolver,
+		clock:      rl.clock,
+		floors:     rl.floors,
+		maxWaiters: rl.maxWaiters,
+		dryRun:     rl.dryRun,
+		allowList:  rl.allowList,
+		denyList:   rl.denyList,
+		debtLimit:  rl.debtLimit,
+		observers:  rl.observers,
+
+		failurePolicy: rl.failurePolicy,
+		breaker:       rl.breaker,
+		local:         rl.local,
+	}
+}
+
+// configFor returns a snapshot of the RateLimit configuration with the Limit resolved for key applied to it.
+// Without a PolicyResolver, or when it returns ErrNoPolicy, the values passed to New() are used
+func (rl *RateLimit) configFor(ctx context.Context, key string) (config, error) {
+	cfg := rl.config()
+	if cfg.resolver == nil {
+		return cfg, nil
+	}
+
+	limit, err := cfg.resolver.Resolve(ctx, key)
+	if errors.Is(err, ErrNoPolicy) {
+		return cfg, nil
+	}
+
+	if err != nil {
+		return config{}, fmt.Errorf("failed to resolve policy: %w", err)
+	}
+
+	return cfg.withLimit(limit), nil
+}
+
+// limit returns the rate, interval and burst of the config
+func (c config) limit() Limit {
+	return Limit{Rate: c.rate, Interval: c.interval, Burst: c.burst}
+}
+
+// withLimit returns a copy of the config with every non-zero field of limit applied to it
+func (c config) withLimit(limit Limit) config {
+	if limit.Rate != 0 {
+		c.rate = limit.Rate
+	}
+
+	if limit.Interval != 0 {
+		c.interval = limit.Interval
+	}
+
+	if limit.Burst != 0 {
+		c.burst = limit.Burst
+	}
+
+	return c
+}
+
+// SetBurst adjusts RateLimit.burst using a RWMutex to lock the struct for safe concurrent use, and emits a
+// ConfigChange to the observers
 func (rl *RateLimit) SetBurst(burst int64) {
 	rl.mu.Lock()
+	old := rl.burst
 	rl.burst = burst
+	observers := rl.observers
 	rl.mu.Unlock()
+
+	notifyChange(observers, ConfigChange{Field: "burst", Old: old, New: burst})
 }
 
-// SetRate adjusts RateLimit.rate using a RWMutex to lock the struct for safe concurrent use
+// SetRate adjusts RateLimit.rate using a RWMutex to lock the struct for safe concurrent use, and emits a
+// ConfigChange to the observers
 func (rl *RateLimit) SetRate(rate int64) {
 	rl.mu.Lock()
+	old := rl.rate
 	rl.rate = rate
+	observers := rl.observers
 	rl.mu.Unlock()
+
+	notifyChange(observers, ConfigChange{Field: "rate", Old: old, New: rate})
 }
 
-// SetInterval adjusts RateLimit.interval using a RWMutex to lock the struct for safe concurrent use
+// SetInterval adjusts RateLimit.interval using a RWMutex to lock the struct for safe concurrent use, and emits a
+// ConfigChange to the observers
 func (rl *RateLimit) SetInterval(interval time.Duration) {
 	rl.mu.Lock()
+	old := rl.interval
 	rl.interval = interval
+	observers := rl.observers
 	rl.mu.Unlock()
+
+	notifyChange(observers, ConfigChange{Field: "interval", Old: old, New: interval})
 }
 
-// SetBackend adjusts RateLimit.backend using a RWMutex to lock the struct for safe concurrent use
+// SetBackend adjusts RateLimit.backend using a RWMutex to lock the struct for safe concurrent use, and emits a
+// ConfigChange to the observers
 func (rl *RateLimit) SetBackend(backend Backend) {
 	rl.mu.Lock()
+	old := rl.backend
 	rl.backend = backend
+	observers := rl.observers
+	// a new backend starts with a closed circuit
+	rl.breaker.reset()
+	rl.mu.Unlock()
+
+	notifyChange(observers, ConfigChange{Field: "backend", Old: old, New: backend})
+}
+
+// SetPolicyResolver adjusts RateLimit.resolver using a RWMutex to lock the struct for safe concurrent use. A nil
+// resolver applies the values passed to New() to every key
+func (rl *RateLimit) SetPolicyResolver(resolver PolicyResolver) {
+	rl.mu.Lock()
+	rl.resolver = resolver
 	rl.mu.Unlock()
 }
 
-// Allow returns time.Duration(timeUntilNextRefill) if the user is limited else it will return time.Duration(0).
+// SetMaxWaiters adjusts RateLimit.maxWaiters using a RWMutex to lock the struct for safe concurrent use. Once
+// maxWaiters goroutines are waiting on a key further calls to Wait() for it fail immediately with ErrQueueFull, a
+// maxWaiters of 0 lets any number of goroutines wait
+func (rl *RateLimit) SetMaxWaiters(maxWaiters int) {
+	rl.mu.Lock()
+	rl.maxWaiters = maxWaiters
+	rl.mu.Unlock()
+}
+
+// SetDryRun adjusts RateLimit.dryRun using a RWMutex to lock the struct for safe concurrent use. In dry-run mode
+// buckets are refilled and spent from as usual but every request is admitted, and the ones the limit rejects have
+// Result.DryRun set, so that a new limit can be observed in production before it is enforced
+func (rl *RateLimit) SetDryRun(dryRun bool) {
+	rl.mu.Lock()
+	rl.dryRun = dryRun
+	rl.mu.Unlock()
+}
+
+// SetDebtLimit adjusts RateLimit.debtLimit using a RWMutex to lock the struct for safe concurrent use, see
+// Overdraft()
+func (rl *RateLimit) SetDebtLimit(debtLimit int64) {
+	rl.mu.Lock()
+	rl.debtLimit = debtLimit
+	rl.mu.Unlock()
+}
+
+// SetClock adjusts RateLimit.clock using a RWMutex to lock the struct for safe concurrent use. Every process sharing
+// a backend should use clocks that agree, since the timestamps they store are compared with each other
+func (rl *RateLimit) SetClock(clock Clock) {
+	rl.mu.Lock()
+	rl.clock = clock
+	rl.mu.Unlock()
+}
+
+// Priority is a class of traffic with its own reserved floor, see RateLimit.SetPriorityFloor()
+type Priority int
+
+const (
+	// PriorityInteractive is the Priority of Allow() and AllowN(), it has no floor unless one is set
+	PriorityInteractive Priority = iota
+	// PriorityBackground is meant for traffic that should be rejected first when a bucket runs low
+	PriorityBackground
+)
+
+// SetPriorityFloor adjusts the floor of priority using a RWMutex to lock the struct for safe concurrent use. Requests
+// of priority are only allowed while the bucket keeps floor (a fraction of burst, rounded up to whole tokens) after
+// spending, so a floor of 0.2 keeps background traffic from using the last 20% of burst. A floor must be within [0, 1)
+func (rl *RateLimit) SetPriorityFloor(priority Priority, floor float64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// the map is copied so that snapshots taken by config() are never mutated
+	floors := make(map[Priority]float64, len(rl.floors)+1)
+	for p, f := range rl.floors {
+		floors[p] = f
+	}
+
+	floors[priority] = floor
+	rl.floors = floors
+}
+
+// Result describes the outcome of Allow() and AllowN()
+type Result struct {
+	// Allowed is true when the requested tokens were spent
+	Allowed bool
+	// Limit is RateLimit.burst, the maximum number of tokens the bucket can hold
+	Limit int64
+	// Remaining is the number of tokens left in the bucket after the call, negative while the key is in debt after
+	// an Overdraft
+	Remaining int64
+	// RetryAfter is the time.Duration until the requested tokens will be available, zero if Allowed unless DryRun.
+	// It is also zero when a deny Rule rejected the request, which no wait can lift, so check Rule before retrying
+	RetryAfter time.Duration
+	// ResetAfter is the time.Duration until the bucket has refilled to Limit, zero if it is full
+	ResetAfter time.Duration
+	// LockedUntil is the time until which the key is locked out by a Penalty, the zero time.Time if it is not
+	LockedUntil time.Time
+	// DryRun is true when the request was rejected by the limit but Allowed because the RateLimit is in dry-run
+	// mode, RetryAfter is then the time.Duration the request would have had to wait
+	DryRun bool
+	// Rule is the allow or deny Rule that matched the key, nil if the request was decided by the limit
+	Rule *Rule
+	// Degraded is true when the backend was unavailable and the request was decided by the FailurePolicy of the
+	// RateLimit, see SetFailurePolicy()
+	Degraded bool
+}
+
+// newResult builds the Result of spending n tokens above floor from a bucket left with allowance tokens, last
+// refilled at lastAccessedTimestampNS
+func newResult(cfg config, currentTime int64, allowed bool, allowance, lastAccessedTimestampNS, n, floor int64) Result {
+	result := Result{
+		Allowed:   allowed,
+		Limit:     cfg.burst,
+		Remaining: allowance,
+	}
+
+	if !allowed {
+		result.RetryAfter = timeUntilAvailable(currentTime, allowance, lastAccessedTimestampNS, n+floor, cfg.interval, cfg.rate)
+	}
+
+	if allowance < cfg.burst {
+		result.ResetAfter = timeUntilAvailable(currentTime, allowance, lastAccessedTimestampNS, cfg.burst, cfg.interval, cfg.rate)
+	}
+
+	return cfg.admit(result)
+}
+
+// admit returns result Allowed with Result.DryRun set if it was rejected while cfg is in dry-run mode
+func (c config) admit(result Result) Result {
+	if c.dryRun && !result.Allowed {
+		result.Allowed = true
+		result.DryRun = true
+	}
+
+	return result
+}
+
+// Allow spends a token from the bucket at key, Result.Allowed is false and Result.RetryAfter is the time.Duration
+// until the next refill if the user is limited.
+//
+// Allow is shorthand for AllowN(key, 1)
+func (rl *RateLimit) Allow(key string) (Result, error) {
+	return rl.AllowNContext(context.Background(), key, 1)
+}
+
+// AllowContext is Allow() bounded by ctx, it is shorthand for AllowNContext(ctx, key, 1)
+func (rl *RateLimit) AllowContext(ctx context.Context, key string) (Result, error) {
+	return rl.AllowNContext(ctx, key, 1)
+}
+
+// AllowN is shorthand for AllowNContext(context.Background(), key, n)
+func (rl *RateLimit) AllowN(key string, n int64) (Result, error) {
+	return rl.AllowNContext(context.Background(), key, n)
+}
+
+// AllowNContext spends n tokens from the bucket at key, or spends none and returns a Result with Allowed set to false and
+// RetryAfter set to the time.Duration until n tokens will be available.
 //
 // This method concurrently accesses RateLimit.rate, RateLimit.burst, and RateLimit.interval, using a
-// RWMutex
+// RWMutex read lock that is released before the backend is called. Calls for the same key are serialized
+// with a striped mutex while calls for unrelated keys proceed in parallel
 //
-// This method returns an error if the underlying calls to RateLimit.backend.GetState() or RateLimit.backend.SetState()
-// return an error. A negative time.Duration will also be returned. The behavior of a negative time.Duration is insignificant
-// when used in time.Sleep() calls, but it felt nominally important to differentiate the response of a failed Allow() beyond err != nil.
-func (rl *RateLimit) Allow(key string) (nextRefill time.Duration, err error) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+// The returned error wraps one of the exported sentinel errors so it can be inspected with errors.Is():
+// ErrInvalidConfig when the rate, interval or burst (after applying any PolicyResolver) are not positive, ErrExceedsBurst when n > RateLimit.burst,
+// ErrCorruptState when the backend cannot parse the stored state and ErrBackendUnavailable for any other
+// error returned by RateLimit.backend.
+//
+// If RateLimit.backend implements AtomicBackend the refill and decrement are delegated to AtomicBackend.Take() so
+// they happen in a single operation on the backend.
+//
+// ctx is passed to the PolicyResolver and to the backend so that a slow backend cannot block the caller past the
+// deadline of ctx, provided the backend implements ContextBackend. The error then wraps ErrBackendUnavailable and
+// ctx.Err()
+func (rl *RateLimit) AllowNContext(ctx context.Context, key string, n int64) (Result, error) {
+	cfg, err := rl.configFor(ctx, key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return rl.allowN(ctx, cfg, key, n, PriorityInteractive)
+}
+
+// AllowPriority is shorthand for AllowPriorityContext(context.Background(), key, n, priority)
+func (rl *RateLimit) AllowPriority(key string, n int64, priority Priority) (Result, error) {
+	return rl.AllowPriorityContext(context.Background(), key, n, priority)
+}
 
-	previousAllowance, previousLastAccessedTimestampNS, err := rl.backend.GetState(key)
+// AllowPriorityContext is AllowNContext() for a request of priority, which is only allowed if the bucket keeps the
+// floor of priority after spending n tokens. Result.RetryAfter is the time.Duration until it does
+func (rl *RateLimit) AllowPriorityContext(ctx context.Context, key string, n int64, priority Priority) (Result, error) {
+	cfg, err := rl.configFor(ctx, key)
 	if err != nil {
-		return -1, err
+		return Result{}, err
+	}
+
+	return rl.allowN(ctx, cfg, key, n, priority)
+}
+
+// allowN is AllowPriorityContext() with the configuration for key already resolved, so that wrappers such as
+// Adaptive can adjust it
+func (rl *RateLimit) allowN(ctx context.Context, cfg config, key string, n int64, priority Priority) (result Result, err error) {
+	var latency time.Duration
+	var failure error
+	defer func() {
+		event := Event{Key: key, Cost: n, Result: result, Latency: latency, Err: err}
+		if err == nil {
+			event.Err = failure
+		}
+		cfg.notify(event)
+	}()
+
+	if err := cfg.validate(); err != nil {
+		return Result{}, err
+	}
+
+	if n < 1 {
+		return Result{}, fmt.Errorf("failed to allowN: n must be positive, got %d", n)
+	}
+
+	if result, ok := cfg.matchRules(key); ok {
+		return result, nil
+	}
+
+	floor := cfg.floor(priority)
+	if n > cfg.burst-floor {
+		return Result{}, fmt.Errorf("failed to allowN: %w (%d > %d)", ErrExceedsBurst, n, cfg.burst-floor)
 	}
 
 	// get the current time as int64 represented in nanoseconds
 	// WARNING: time.Now.Unix() will return a representation in seconds which requires an additional conversion to compare, so we use .UnixNano()
-	currentTime := time.Now().UnixNano()
+	currentTime := cfg.clock.Now().UnixNano()
+	var allowed bool
+	var allowance, lastAccessedTimestampNS int64
+	start := time.Now()
+	failure, err = cfg.guard(ctx, "allowN", func(cfg config) (err error) {
+		allowed, allowance, lastAccessedTimestampNS, err = take(ctx, rl.keyLocks, cfg, key, n, floor, currentTime)
+		return err
+	})
+	latency = time.Since(start)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if failure != nil && cfg.failurePolicy != FailLocal {
+		return cfg.failedResult(), nil
+	}
+
+	result = newResult(cfg, currentTime, allowed, allowance, lastAccessedTimestampNS, n, floor)
+	result.Degraded = failure != nil
+	return result, nil
+}
+
+// take refills the bucket at key and spends cost tokens from it if enough are available. A negative cost returns
+// tokens to the bucket without filling it beyond burst. Tokens are only spent if floor tokens are left afterwards.
+// The returned allowance and lastAccessedTimestampNS are the state stored after the call. keyLocks serializes the GetState()/SetState() round trip of backends without
+// AtomicBackend or UpdateBackend
+func take(ctx context.Context, keyLocks stripedMutex, cfg config, key string, cost, floor, currentTime int64) (allowed bool, allowance, lastAccessedTimestampNS int64, err error) {
+	if atomicBackend, ok := cfg.backend.(AtomicBackend); ok {
+		return atomicBackend.Take(ctx, key, cost, floor, cfg.rate, int64(cfg.interval), cfg.burst, currentTime)
+	}
+
+	if updateBackend, ok := cfg.backend.(UpdateBackend); ok {
+		err := updateBackend.Update([]string{key}, func(allowances, lastAccessedTimestampsNS []int64) bool {
+			allowed, allowances[0], lastAccessedTimestampsNS[0] = takeAllowance(
+				currentTime,
+				allowances[0],
+				lastAccessedTimestampsNS[0],
+				cost,
+				floor,
+				cfg.burst,
+				int64(cfg.interval),
+				cfg.rate,
+			)
+			allowance, lastAccessedTimestampNS = allowances[0], lastAccessedTimestampsNS[0]
+			return true
+		})
+		return allowed, allowance, lastAccessedTimestampNS, err
+	}
+
+	// serialize the GetState()/SetState() round trip for this key only, other keys proceed in parallel
+	keyLock := keyLocks.lock(key)
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	previousAllowance, previousLastAccessedTimestampNS, err := getState(ctx, cfg.backend, key)
+	if err != nil {
+		return false, 0, 0, err
+	}
 
 	// 1) Refill the allowance by the quantity of RateLimit.interval that has passed since lastAccessedTimestampNS
 	// 2) If the refilled allowance is > RateLimit.burst, cap the refilled allowance to RateLimit.burst
-	newAllowance, newLastAccessedTimestampNS := refillAllowance(
-		currentTime, 
+	// 3) If the allowance covers cost and floor, decrement it by cost
+	allowed, allowance, lastAccessedTimestampNS = takeAllowance(
+		currentTime,
 		previousAllowance,
-		previousLastAccessedTimestampNS, 
-		rl.burst, 
-		int64(rl.interval),
-		rl.rate,
+		previousLastAccessedTimestampNS,
+		cost,
+		floor,
+		cfg.burst,
+		int64(cfg.interval),
+		cfg.rate,
 	)
 
-	// 3) If we have an allowance decrement, save the new state, and return time.Duration(0)
-	if newAllowance > 0 {
-		// prepare the new state
-		newAllowance = newAllowance - 1
+	// 4) Save the new state whether or not the allowance was decremented so the refill is kept
+	if err := setState(ctx, cfg.backend, key, allowance, lastAccessedTimestampNS); err != nil {
+		return false, 0, 0, err
+	}
 
-		// save the new state
-		if err := rl.backend.SetState(key, newAllowance, newLastAccessedTimestampNS); err != nil {
-			return -1, err
-		}
+	return allowed, allowance, lastAccessedTimestampNS, nil
+}
 
-		// return a duration of zero signaling that another action can begin immediately without blocking
-		return time.Duration(0), nil
+// timeUntilAvailable returns the time.Duration until a bucket holding allowance tokens and last refilled at
+// lastAccessedTimestampNS holds at least n tokens
+func timeUntilAvailable(currentTime, allowance, lastAccessedTimestampNS, n int64, interval time.Duration, rate int64) time.Duration {
+	if allowance >= n {
+		return 0
 	}
 
-	// 4) Else save the new state and return the time.Duration until the next refill
-	if err := rl.backend.SetState(key, newAllowance, newLastAccessedTimestampNS); err != nil {
-		return -1, err
+	if rate <= 0 {
+		return interval
 	}
 
-	// if !intervalHasPassed we can return a rl.interval - elapsed 
-	intervalHasPassed := (previousLastAccessedTimestampNS + int64(rl.interval)) <= currentTime
-	if !intervalHasPassed {
-		elapsed := time.Duration(currentTime - previousLastAccessedTimestampNS)
-		nextRefill := rl.interval - elapsed
-		return nextRefill, nil  
+	// round the number of refills needed up, a partial refill never happens
+	intervalsNeeded := (n - allowance + rate - 1) / rate
+	elapsed := time.Duration(currentTime - lastAccessedTimestampNS)
+	wait := time.Duration(intervalsNeeded)*interval - elapsed
+	if wait <= 0 {
+		return interval
 	}
 
-	//
-	return rl.interval, nil
+	return wait
 }
 
-func refillAllowance(currentTime, previousAllowance, previousLastAccessedTimestampNS, burst, interval, rate int64)(newAllowance, newLastAccessedTimestampNS int64){
-	bucketHasRoom := previousAllowance < burst 
-	intervalHasPassed := (previousLastAccessedTimestampNS + interval) <= currentTime
-
-	if bucketHasRoom && intervalHasPassed {
-		// compute how much we should add to the allowance 
-		elapsed := currentTime - previousLastAccessedTimestampNS
-		intervalsPassed := elapsed / interval 
-		allowanceRestored := rate * intervalsPassed
+// takeAllowance refills the bucket with refillAllowance() and then decrements the refilled allowance by cost if it is
+// large enough to leave floor tokens. When it is not, the refilled allowance is returned untouched and allowed is false.
+//
+// A negative cost returns tokens to the bucket, which never fills it beyond burst (or beyond the refilled allowance
+// if that was already larger than burst)
+func takeAllowance(currentTime, previousAllowance, previousLastAccessedTimestampNS, cost, floor, burst, interval, rate int64) (allowed bool, newAllowance, newLastAccessedTimestampNS int64) {
+	newAllowance, newLastAccessedTimestampNS = refillAllowance(currentTime, previousAllowance, previousLastAccessedTimestampNS, burst, interval, rate)
+	if cost < 0 {
+		ceiling := burst
+		if newAllowance > ceiling {
+			ceiling = newAllowance
+		}
 
-		// ensure newAllowance does not surpass burst 
-		newAllowance := previousAllowance + allowanceRestored
-		if newAllowance > burst {
-			newAllowance = burst 
+		newAllowance = newAllowance - cost
+		if newAllowance > ceiling {
+			newAllowance = ceiling
 		}
 
-		// always return currentTime
-		return newAllowance, currentTime
+		return true, newAllowance, newLastAccessedTimestampNS
+	}
+
+	if newAllowance-cost < floor {
+		return false, newAllowance, newLastAccessedTimestampNS
 	}
 
-	// if no changes are made to the allowance, return the previous allowance and accessedTimestamp
-	return previousAllowance, previousLastAccessedTimestampNS
-}
\ No newline at end of file
+	return true, newAllowance - cost, newLastAccessedTimestampNS
+}
+
+// refillAllowance adds RateLimit.rate tokens for every whole interval that has passed since
+// previousLastAccessedTimestampNS, up to burst.
+//
+// The timestamp is only advanced by the whole intervals that were refilled so the remainder of a partially elapsed
+// interval keeps counting towards the next refill, i.e. with a rate of 1 per second calls at 1.9s and then 2.8s
+// refill 2 tokens, not 1. Once the bucket is full the timestamp is set to currentTime because a full bucket accrues
+// no progress, otherwise the time spent full would be refilled as soon as a token is spent
+func refillAllowance(currentTime, previousAllowance, previousLastAccessedTimestampNS, burst, interval, rate int64) (newAllowance, newLastAccessedTimestampNS int64) {
+	bucketHasRoom := previousAllowance < burst
+	if !bucketHasRoom {
+		return previousAllowance, currentTime
+	}
+
+	// a negative elapsed (i.e. clock skew between processes sharing a backend) refills nothing
+	elapsed := currentTime - previousLastAccessedTimestampNS
+	intervalsPassed := elapsed / interval
+	if intervalsPassed < 1 || rate < 1 {
+		// if no changes are made to the allowance, return the previous allowance and accessedTimestamp
+		return previousAllowance, previousLastAccessedTimestampNS
+	}
+
+	// compare against the intervals needed to fill the bucket before multiplying so a timestamp of 0 (a key seen
+	// for the first time) cannot overflow rate * intervalsPassed
+	intervalsUntilFull := (burst - previousAllowance + rate - 1) / rate
+	if intervalsPassed >= intervalsUntilFull {
+		return burst, currentTime
+	}
+
+	return previousAllowance + rate*intervalsPassed, previousLastAccessedTimestampNS + intervalsPassed*interval
+}
@@ -1,18 +1,23 @@
 package ratelimit
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/beeekind/ratelimit/memory"
+	"github.com/beeekind/ratelimit/ratelimittest"
 )
 
 var (
-	defaultTestRate      = int64(1)
-	defaultTestBurst     = int64(10)
-	defaultTestInterval  = time.Second
-	defaultMemoryBackend = memory.New()
-	defaultLimiter       = New(defaultTestRate, defaultTestInterval, defaultTestBurst, defaultMemoryBackend)
+	defaultTestRate     = int64(1)
+	defaultTestBurst    = int64(10)
+	defaultTestInterval = time.Second
 )
 
 type refillAllowanceInput struct {
@@ -39,12 +44,21 @@ var fiveSecondAgo = tNow.Add(-5 * time.Second).UnixNano()
 
 var refillAllowanceTests = map[refillAllowanceInput]refillAllowanceOutput{
 	// the following cases should not result in a refill
-	{"!bucketHasRoom results in no refill", now, 6, 0, 5, 10, 10}:    {6, 0},
-	{"!intervalhasPassed results in no refill", 0, 7, 0, 10, 10, 10}: {7, 0},
+	{"!bucketHasRoom results in no refill and accrues no progress", now, 6, 0, 5, 10, 10}:    {6, now},
+	{"!intervalhasPassed results in no refill", 0, 7, 0, 10, 10, 10}:                         {7, 0},
+	{"partial interval results in no refill", now, 3, now - second/2, 10, second, 1}:         {3, now - second/2},
+	{"lastAccessed in the future results in no refill", now, 3, now + second, 10, second, 1}: {3, now + second},
 	// the following cases should cause a refill
 	{"elapsed > 10 years results in max refill", now, 5, 0, 10, second, 1}:       {10, now},
 	{"elapsed == rate results in 1 refill", now, 5, oneSecondAgo, 10, second, 1}: {6, now},
 	{"should refill 5 in 5 seconds", now, 0, fiveSecondAgo, 5, second, 1}:        {5, now},
+	// the following cases should keep the progress of a partially elapsed interval
+	{"1.9 intervals refills 1 and keeps 0.9", now, 0, now - 19*second/10, 10, second, 1}:            {1, now - 9*second/10},
+	{"2.8 intervals after 1.9 refills the second token", now, 1, now - 18*second/10, 10, second, 1}: {2, now - 8*second/10},
+	{"2.5 intervals at rate 3 refills 6 and keeps 0.5", now, 0, now - 5*second/2, 10, second, 3}:    {6, now - second/2},
+	{"refill reaching burst discards the remainder", now, 8, now - 7*second/2, 10, second, 1}:       {10, now},
+	{"refill one short of burst keeps the remainder", now, 5, now - 9*second/2, 10, second, 1}:      {9, now - second/2},
+	{"negative allowance refills from below zero", now, -3, now - 2*second, 10, second, 1}:          {-1, now},
 }
 
 func TestRefillAllowance(t *testing.T) {
@@ -72,96 +86,481 @@ func TestRefillAllowance(t *testing.T) {
 	}
 }
 
-func TestAllowsBurst(t *testing.T) {
-	t.Skip()
-	u1 := "Foo"
+type takeAllowanceInput struct {
+	desc                            string
+	currentTime                     int64
+	previousAllowance               int64
+	previousLastAccessedTimestampNS int64
+	cost                            int64
+	floor                           int64
+	burst                           int64
+	interval                        int64
+	rate                            int64
+}
+
+type takeAllowanceOutput struct {
+	expectedAllowed                    bool
+	expectedNewAllowance               int64
+	expectedNewLastAccessedTimestampNS int64
+}
+
+var takeAllowanceTests = map[takeAllowanceInput]takeAllowanceOutput{
+	{"cost within allowance is spent", now, 5, now, 3, 0, 10, second, 1}:                    {true, 2, now},
+	{"cost equal to allowance empties the bucket", now, 5, now, 5, 0, 10, second, 1}:        {true, 0, now},
+	{"cost above allowance spends nothing", now, 2, now, 3, 0, 10, second, 1}:               {false, 2, now},
+	{"refill is applied before spending", now, 2, oneSecondAgo, 3, 0, 10, second, 1}:        {true, 0, now},
+	{"refill is kept when cost is not covered", now, 0, fiveSecondAgo, 6, 0, 10, second, 1}: {false, 5, now},
+	{"negative cost returns tokens", now, 2, now, -3, 0, 10, second, 1}:                     {true, 5, now},
+	{"negative cost never fills beyond burst", now, 8, now, -3, 0, 10, second, 1}:           {true, 10, now},
+	{"negative cost keeps an allowance above burst", now, 12, now, -3, 0, 10, second, 1}:    {true, 12, now},
+	{"cost leaving the floor is spent", now, 5, now, 3, 2, 10, second, 1}:                   {true, 2, now},
+	{"cost dipping below the floor spends nothing", now, 5, now, 4, 2, 10, second, 1}:       {false, 5, now},
+	{"refill counts towards the floor", now, 3, oneSecondAgo, 2, 2, 10, second, 1}:          {true, 2, now},
+	{"negative cost ignores the floor", now, 1, now, -2, 2, 10, second, 1}:                  {true, 3, now},
+}
+
+func TestTakeAllowance(t *testing.T) {
+	for in, out := range takeAllowanceTests {
+		allowed, newAllowance, newLastAccessedTimestampNS := takeAllowance(
+			in.currentTime,
+			in.previousAllowance,
+			in.previousLastAccessedTimestampNS,
+			in.cost,
+			in.floor,
+			in.burst,
+			in.interval,
+			in.rate,
+		)
 
-	successfulActions := 0
-	for i := 0; i < 11; i++ {
-		waitTime, _ := defaultLimiter.Allow(u1)
-		if waitTime == 0 {
-			successfulActions++
-			continue
+		if allowed != out.expectedAllowed {
+			t.Logf("(test %s) allowed %v != expectedAllowed %v", in.desc, allowed, out.expectedAllowed)
+			t.Fail()
 		}
 
-		time.Sleep(waitTime)
+		if newAllowance != out.expectedNewAllowance {
+			t.Logf("(test %s) newAllowance %v != expectedNewAllowance %v", in.desc, newAllowance, out.expectedNewAllowance)
+			t.Fail()
+		}
+
+		if newLastAccessedTimestampNS != out.expectedNewLastAccessedTimestampNS {
+			t.Logf("(test %s) lastAccessed %v != expectedLastAccessed %v", in.desc, newLastAccessedTimestampNS, out.expectedNewLastAccessedTimestampNS)
+			t.Fail()
+		}
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, memory.New())
+	key := "allowN"
+
+	for i := 0; i < 2; i++ {
+		result, err := limiter.AllowN(key, 4)
+		if err != nil || !result.Allowed {
+			t.Logf("AllowN(4) #%v returned %+v err %v", i, result, err)
+			t.Fail()
+		}
+	}
+
+	// 2 tokens remain so 4 tokens are available after 2 more refills
+	result, err := limiter.AllowN(key, 4)
+	if err != nil || result.Allowed || result.RetryAfter <= defaultTestInterval || result.RetryAfter > 2*defaultTestInterval {
+		t.Logf("AllowN(4) on a bucket of 2 returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	// the failed AllowN must not have spent the remaining tokens
+	result, err = limiter.AllowN(key, 2)
+	if err != nil || !result.Allowed || result.Remaining != 0 || result.Limit != defaultTestBurst {
+		t.Logf("AllowN(2) returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	if result.ResetAfter <= 9*defaultTestInterval || result.ResetAfter > 10*defaultTestInterval {
+		t.Logf("Result.ResetAfter %v of an empty bucket is not within (%v, %v]", result.ResetAfter, 9*defaultTestInterval, 10*defaultTestInterval)
+		t.Fail()
 	}
 
-	if successfulActions != 10 {
+	if _, err := limiter.AllowN(key, defaultTestBurst+1); !errors.Is(err, ErrExceedsBurst) {
+		t.Logf("AllowN(burst+1) returned err %v", err)
 		t.Fail()
 	}
 }
 
-func TestAllowLimitEasesAfterWait(t *testing.T) {
-	t.Skip()
-	u2 := "Bar"
+func TestAllowPriority(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, clock := newTestLimiter(backend)
+		limiter.SetPriorityFloor(PriorityBackground, 0.2)
+		key := "priority"
+
+		// background traffic cannot use the last 20% of burst
+		result, err := limiter.AllowPriority(key, 8, PriorityBackground)
+		if err != nil || !result.Allowed {
+			t.Logf("(%s) AllowPriority(8, background) returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		result, err = limiter.AllowPriority(key, 1, PriorityBackground)
+		if err != nil || result.Allowed || result.Remaining != 2 || result.RetryAfter != defaultTestInterval {
+			t.Logf("(%s) AllowPriority(1, background) at the floor returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		// interactive traffic keeps working
+		result, err = limiter.AllowN(key, 2)
+		if err != nil || !result.Allowed || result.Remaining != 0 {
+			t.Logf("(%s) AllowN(2) below the background floor returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		// background traffic resumes once the bucket has refilled above its floor
+		clock.Advance(3 * defaultTestInterval)
+		if result, err = limiter.AllowPriority(key, 1, PriorityBackground); err != nil || !result.Allowed {
+			t.Logf("(%s) AllowPriority(1, background) after refilling returned %+v err %v", name, result, err)
+			t.Fail()
+		}
 
-	successfulActions := 0
-	failedActions := 0
-	for i := 0; i < 20; i++ {
-		waitTime, _ := defaultLimiter.Allow(u2)
-		if waitTime == 0 {
-			successfulActions++
-			continue
+		if _, err := limiter.AllowPriority(key, 9, PriorityBackground); !errors.Is(err, ErrExceedsBurst) {
+			t.Logf("(%s) AllowPriority(9, background) returned err %v", name, err)
+			t.Fail()
 		}
 
-		failedActions++
-		time.Sleep(waitTime)
+		limiter.SetPriorityFloor(PriorityBackground, 1)
+		if _, err := limiter.AllowPriority(key, 1, PriorityBackground); !errors.Is(err, ErrInvalidConfig) {
+			t.Logf("(%s) a floor of 1 returned err %v", name, err)
+			t.Fail()
+		}
 	}
+}
+
+// erroringBackend returns err from every call
+type erroringBackend struct {
+	err error
+}
+
+func (b *erroringBackend) GetState(key string) (int64, int64, error) {
+	return 0, 0, b.err
+}
+
+func (b *erroringBackend) SetState(key string, allowance int64, lastAccessedTimestampNS int64) error {
+	return b.err
+}
 
-	if successfulActions != 15 {
-		t.Logf("unexpected successfulActions %v != %v\n", successfulActions, 15)
+func TestAllowErrors(t *testing.T) {
+	connectionRefused := errors.New("connection refused")
+	unavailable := New(defaultTestRate, defaultTestInterval, defaultTestBurst, &erroringBackend{connectionRefused})
+	if _, err := unavailable.Allow("errors"); !errors.Is(err, ErrBackendUnavailable) || !errors.Is(err, connectionRefused) {
+		t.Logf("failing backend returned err %v", err)
 		t.Fail()
 	}
 
-	if failedActions != 5 {
-		t.Logf("unexpected failedActions %v != %v\n", failedActions, 5)
+	corrupt := New(defaultTestRate, defaultTestInterval, defaultTestBurst, &erroringBackend{fmt.Errorf("bad value: %w", ErrCorruptState)})
+	if _, err := corrupt.Allow("errors"); !errors.Is(err, ErrCorruptState) || errors.Is(err, ErrBackendUnavailable) {
+		t.Logf("corrupt backend returned err %v", err)
+		t.Fail()
+	}
+
+	invalid := New(0, defaultTestInterval, defaultTestBurst, memory.New())
+	if _, err := invalid.Allow("errors"); !errors.Is(err, ErrInvalidConfig) {
+		t.Logf("zero rate returned err %v", err)
 		t.Fail()
 	}
 }
 
-func TestConcurrentUse(t *testing.T) {
-	t.Skip()
-	u3 := "baz"
-
-	successCh := make(chan int)
-	failureCh := make(chan int)
-
-	simulatedUsers := 5
-
-	for i := 0; i < simulatedUsers; i++ {
-		go func(rl *RateLimit, key string, successCh chan int, failureCh chan int) {
-			successes := 0
-			failures := 0
-			for i := 0; i < 20; i++ {
-				wait, _ := rl.Allow(key)
-				if wait == 0 {
-					successes++
-				} else {
-					failures++
-					time.Sleep(wait)
-				}
-			}
+// contextBackend implements ContextBackend over a Backend, failing with ctx.Err() once ctx is done and recording
+// the contexts it is called with
+type contextBackend struct {
+	backend  Backend
+	contexts []context.Context
+}
+
+func (b *contextBackend) GetState(key string) (int64, int64, error) {
+	return b.GetStateContext(context.Background(), key)
+}
 
-			successCh <- successes
-			failureCh <- failures
-		}(defaultLimiter, u3, successCh, failureCh)
+func (b *contextBackend) SetState(key string, allowance int64, lastAccessedTimestampNS int64) error {
+	return b.SetStateContext(context.Background(), key, allowance, lastAccessedTimestampNS)
+}
+
+func (b *contextBackend) GetStateContext(ctx context.Context, key string) (int64, int64, error) {
+	b.contexts = append(b.contexts, ctx)
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
 	}
 
-	totalSuccesses := 0
-	totalFailures := 0
-	for i := 0; i < simulatedUsers; i++ {
-		totalSuccesses += <-successCh
-		totalFailures += <-failureCh
+	return b.backend.GetState(key)
+}
+
+func (b *contextBackend) SetStateContext(ctx context.Context, key string, allowance int64, lastAccessedTimestampNS int64) error {
+	b.contexts = append(b.contexts, ctx)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	if 22 > totalSuccesses || totalSuccesses > 28 {
-		t.Logf("unexpected totalSuccesses the following is not true 22 < %v < 28\n", totalSuccesses)
+	return b.backend.SetState(key, allowance, lastAccessedTimestampNS)
+}
+
+type contextKey struct{}
+
+func TestAllowContext(t *testing.T) {
+	backend := &contextBackend{backend: memory.New()}
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, backend)
+
+	ctx := context.WithValue(context.Background(), contextKey{}, "span")
+	result, err := limiter.AllowContext(ctx, "context")
+	if err != nil || !result.Allowed {
+		t.Logf("AllowContext returned %+v err %v", result, err)
 		t.Fail()
 	}
 
-	if 72 > totalFailures || totalFailures > 77 {
-		t.Logf("unexpected totalFailures the folling is not true 72 <  %v < 77\n", totalFailures)
+	if len(backend.contexts) != 2 || backend.contexts[0].Value(contextKey{}) != "span" || backend.contexts[1].Value(contextKey{}) != "span" {
+		t.Logf("the context was not passed to GetStateContext() and SetStateContext(): %v", backend.contexts)
 		t.Fail()
 	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.AllowContext(cancelled, "context"); !errors.Is(err, context.Canceled) || !errors.Is(err, ErrBackendUnavailable) {
+		t.Logf("AllowContext with a cancelled context returned err %v", err)
+		t.Fail()
+	}
+}
+
+// newTestLimiter returns a RateLimit with the default test configuration whose time only moves with the returned
+// ratelimittest.Clock
+func newTestLimiter(backend Backend) (*RateLimit, *ratelimittest.Clock) {
+	clock := ratelimittest.NewClock(tNow)
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, backend)
+	limiter.SetClock(clock)
+	return limiter, clock
+}
+
+// testBackends returns a fresh instance of every kind of Backend RateLimit handles differently
+func testBackends() map[string]Backend {
+	return map[string]Backend{
+		"memory":   memory.New(),
+		"getState": &plainBackend{memory.New()},
+		"atomic":   &atomicBackend{backend: memory.New()},
+		"multi":    &multiBackend{backend: memory.New()},
+	}
+}
+
+// atomicBackend implements AtomicBackend over the GetState()/SetState() of backend the way the redis scripts do, and
+// records the arguments of its last Take() call
+type atomicBackend struct {
+	backend Backend
+	mu      sync.Mutex
+	calls   int
+	last    [6]int64
+}
+
+func (b *atomicBackend) GetState(key string) (int64, int64, error) {
+	return b.backend.GetState(key)
+}
+
+func (b *atomicBackend) SetState(key string, allowance int64, lastAccessedTimestampNS int64) error {
+	return b.backend.SetState(key, allowance, lastAccessedTimestampNS)
+}
+
+func (b *atomicBackend) Take(ctx context.Context, key string, cost, floor, rate, interval, burst, now int64) (bool, int64, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls++
+	b.last = [6]int64{cost, floor, rate, interval, burst, now}
+	allowance, lastAccessedTimestampNS, err := b.backend.GetState(key)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	allowed, allowance, lastAccessedTimestampNS := takeAllowance(now, allowance, lastAccessedTimestampNS, cost, floor, burst, interval, rate)
+	if err := b.backend.SetState(key, allowance, lastAccessedTimestampNS); err != nil {
+		return false, 0, 0, err
+	}
+
+	return allowed, allowance, lastAccessedTimestampNS, nil
+}
+
+func TestAtomicBackendTake(t *testing.T) {
+	backend := &atomicBackend{backend: memory.New()}
+	limiter, clock := newTestLimiter(backend)
+	limiter.SetPriorityFloor(PriorityBackground, 0.2)
+	key := "atomic"
+
+	result, err := limiter.AllowPriority(key, 3, PriorityBackground)
+	if err != nil || !result.Allowed || result.Remaining != defaultTestBurst-3 {
+		t.Logf("AllowPriority() returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	want := [6]int64{3, 2, defaultTestRate, int64(defaultTestInterval), defaultTestBurst, clock.Now().UnixNano()}
+	if backend.calls != 1 || backend.last != want {
+		t.Logf("Take() was called %d times with %v, wanted once with %v", backend.calls, backend.last, want)
+		t.Fail()
+	}
+}
+
+func TestAllowsBurst(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, clock := newTestLimiter(backend)
+		u1 := "Foo"
+
+		successfulActions := 0
+		for i := 0; i < 11; i++ {
+			result, _ := limiter.Allow(u1)
+			if result.Allowed {
+				successfulActions++
+				continue
+			}
+
+			clock.Advance(result.RetryAfter)
+		}
+
+		if successfulActions != 10 {
+			t.Logf("(%s) unexpected successfulActions %v != %v", name, successfulActions, 10)
+			t.Fail()
+		}
+	}
+}
+
+func TestAllowLimitEasesAfterWait(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, clock := newTestLimiter(backend)
+		u2 := "Bar"
+
+		successfulActions := 0
+		failedActions := 0
+		for i := 0; i < 20; i++ {
+			result, _ := limiter.Allow(u2)
+			if result.Allowed {
+				successfulActions++
+				continue
+			}
+
+			failedActions++
+			clock.Advance(result.RetryAfter)
+		}
+
+		if successfulActions != 15 {
+			t.Logf("(%s) unexpected successfulActions %v != %v\n", name, successfulActions, 15)
+			t.Fail()
+		}
+
+		if failedActions != 5 {
+			t.Logf("(%s) unexpected failedActions %v != %v\n", name, failedActions, 5)
+			t.Fail()
+		}
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	for name, backend := range testBackends() {
+		// the clock never moves so exactly burst calls succeed however the goroutines interleave
+		limiter, _ := newTestLimiter(backend)
+		u3 := "baz"
+
+		successCh := make(chan int)
+		failureCh := make(chan int)
+
+		simulatedUsers := 5
+
+		for i := 0; i < simulatedUsers; i++ {
+			go func(rl *RateLimit, key string, successCh chan int, failureCh chan int) {
+				successes := 0
+				failures := 0
+				for i := 0; i < 20; i++ {
+					result, _ := rl.Allow(key)
+					if result.Allowed {
+						successes++
+					} else {
+						failures++
+					}
+				}
+
+				successCh <- successes
+				failureCh <- failures
+			}(limiter, u3, successCh, failureCh)
+		}
+
+		totalSuccesses := 0
+		totalFailures := 0
+		for i := 0; i < simulatedUsers; i++ {
+			totalSuccesses += <-successCh
+			totalFailures += <-failureCh
+		}
+
+		if totalSuccesses != 10 {
+			t.Logf("(%s) unexpected totalSuccesses %v != %v\n", name, totalSuccesses, 10)
+			t.Fail()
+		}
+
+		if totalFailures != 90 {
+			t.Logf("(%s) unexpected totalFailures %v != %v\n", name, totalFailures, 90)
+			t.Fail()
+		}
+	}
+}
+
+// BenchmarkAllowParallel gives every goroutine its own key so that, with the striped key locks, throughput
+// should scale with GOMAXPROCS (compare go test -bench AllowParallel -cpu 1,2,4,8)
+func BenchmarkAllowParallel(b *testing.B) {
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, memory.New())
+	goroutines := int64(0)
+
+	b.RunParallel(func(pb *testing.PB) {
+		key := strconv.FormatInt(atomic.AddInt64(&goroutines, 1), 10)
+		for pb.Next() {
+			if _, err := limiter.Allow(key); err != nil {
+				b.Log(err.Error())
+				b.FailNow()
+			}
+		}
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, clock := newTestLimiter(backend)
+		limiter.SetDryRun(true)
+		key := "dryRun"
+
+		result, err := limiter.AllowN(key, defaultTestBurst)
+		if err != nil || !result.Allowed || result.DryRun || result.Remaining != 0 {
+			t.Logf("(%s) AllowN(burst) in dry-run mode returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		// the bucket is empty, the request is admitted but reported
+		result, err = limiter.Allow(key)
+		if err != nil || !result.Allowed || !result.DryRun || result.Remaining != 0 || result.RetryAfter != defaultTestInterval {
+			t.Logf("(%s) Allow() on an empty bucket in dry-run mode returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		reservation, err := limiter.Reserve(key, 1)
+		if err != nil || !reservation.OK() {
+			t.Fatalf("(%s) Reserve() in dry-run mode returned %+v err %v", name, reservation, err)
+		}
+
+		// nothing was taken so nothing may be returned
+		if err := reservation.Cancel(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, err := limiter.Status(key); err != nil || status.Allowance != 0 {
+			t.Logf("(%s) Cancel() of a dry-run reservation left %+v err %v", name, status, err)
+			t.Fail()
+		}
+
+		limiter.SetDryRun(false)
+		if result, err = limiter.Allow(key); err != nil || result.Allowed || result.DryRun {
+			t.Logf("(%s) Allow() on an empty bucket after dry-run mode returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+
+		clock.Advance(defaultTestInterval)
+		if result, err = limiter.Allow(key); err != nil || !result.Allowed {
+			t.Logf("(%s) Allow() after refilling returned %+v err %v", name, result, err)
+			t.Fail()
+		}
+	}
 }
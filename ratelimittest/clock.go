@@ -0,0 +1,91 @@
+// Package ratelimittest provides helpers for testing code that uses beeekind/ratelimit, such as a Clock that
+// only moves when it is told to so that bursts and refills can be tested exactly and without sleeping.
+//
+// It does not import beeekind/ratelimit so that the tests of beeekind/ratelimit itself can use it
+package ratelimittest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a manually advanced implementation of ratelimit.Clock. Its time only changes with Advance() and Set()
+type Clock struct {
+	// mu protects now and waiters
+	mu  *sync.Mutex
+	now time.Time
+	// waiters are the channels returned by After() that have not fired yet
+	waiters []waiter
+}
+
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewClock returns a new instance of Clock set to now
+func NewClock(now time.Time) *Clock {
+	return &Clock{
+		mu:  &sync.Mutex{},
+		now: now,
+	}
+}
+
+// Now returns the time the Clock is set to
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the time of the Clock once it has been advanced by d or more. A d <= 0
+// fires immediately
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, waiter{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the Clock forward by d and fires every channel returned by After() whose duration has elapsed
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	now := c.now.Add(d)
+	c.mu.Unlock()
+
+	c.Set(now)
+}
+
+// Set moves the Clock to now, which may be before its current time, and fires every channel returned by After()
+// whose duration has elapsed
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(now) {
+			pending = append(pending, w)
+			continue
+		}
+
+		w.ch <- now
+	}
+	c.waiters = pending
+}
+
+// Waiters returns the number of channels returned by After() that have not fired yet, so a test can wait for a
+// goroutine to block on the Clock before advancing it
+func (c *Clock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
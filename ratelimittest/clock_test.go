@@ -0,0 +1,68 @@
+package ratelimittest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clock := NewClock(start)
+
+	if !clock.Now().Equal(start) {
+		t.Logf("Now() %v != %v", clock.Now(), start)
+		t.Fail()
+	}
+
+	clock.Advance(time.Second)
+	if want := start.Add(time.Second); !clock.Now().Equal(want) {
+		t.Logf("Now() after Advance(1s) %v != %v", clock.Now(), want)
+		t.Fail()
+	}
+
+	select {
+	case <-clock.After(0):
+	default:
+		t.Log("After(0) did not fire immediately")
+		t.Fail()
+	}
+
+	first := clock.After(time.Second)
+	second := clock.After(2 * time.Second)
+	if clock.Waiters() != 2 {
+		t.Logf("Waiters() %v != 2", clock.Waiters())
+		t.Fail()
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case fired := <-first:
+		if !fired.Equal(start.Add(2 * time.Second)) {
+			t.Logf("After(1s) fired with %v", fired)
+			t.Fail()
+		}
+	default:
+		t.Log("After(1s) did not fire after Advance(1s)")
+		t.Fail()
+	}
+
+	select {
+	case <-second:
+		t.Log("After(2s) fired after Advance(1s)")
+		t.Fail()
+	default:
+	}
+
+	clock.Set(start.Add(10 * time.Second))
+	select {
+	case <-second:
+	default:
+		t.Log("After(2s) did not fire after Set()")
+		t.Fail()
+	}
+
+	if clock.Waiters() != 0 {
+		t.Logf("Waiters() %v != 0", clock.Waiters())
+		t.Fail()
+	}
+}
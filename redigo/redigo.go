@@ -13,11 +13,14 @@ package redigo
 // Note that we are coercing a int64 value to and from a string using strconv.ParseInt(val, 10, 64)
 // and strconv.FormatInt(val, 10).
 import (
-	"errors"
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/beeekind/ratelimit"
+	"github.com/beeekind/ratelimit/internal/script"
 	"github.com/gomodule/redigo/redis"
 )
 
@@ -30,6 +33,16 @@ type Backend struct {
 const allowanceKey = "0"
 const accessedKey = "1"
 
+// takeScript refills and spends a bucket stored as a hash set in one round trip
+var takeScript = redis.NewScript(1, script.Take)
+
+// takeAllScript refills several buckets and spends from all of them or none of them in one round trip, its key
+// count is passed as the first argument
+var takeAllScript = redis.NewScript(-1, script.TakeAll)
+
+// acquireLeaseScript adds a lease to a sorted set scored by expiry unless the limit of unexpired leases is reached
+var acquireLeaseScript = redis.NewScript(1, script.AcquireLease)
+
 // New returns a new instance of this backend
 func New(pool *redis.Pool) *Backend {
 	return &Backend{
@@ -37,55 +50,217 @@ func New(pool *redis.Pool) *Backend {
 	}
 }
 
-func (b *Backend) poolDo(commandName string, args ...interface{}) (reply interface{}, err error) {
-	conn := b.pool.Get()
+// conn gets a connection from the pool, waiting for one no longer than ctx allows. When ctx has a deadline every
+// command sent on the connection times out at that deadline
+func (b *Backend) conn(ctx context.Context) (redis.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := b.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		return &deadlineConn{Conn: conn, deadline: deadline}, nil
+	}
+
+	return conn, nil
+}
+
+// deadlineConn sends every command with redis.DoWithTimeout() so that it returns by deadline, redigo has no way of
+// cancelling a command that is already waiting for a reply
+type deadlineConn struct {
+	redis.Conn
+	deadline time.Time
+}
+
+// Do implements redis.Conn
+func (c *deadlineConn) Do(commandName string, args ...interface{}) (reply interface{}, err error) {
+	timeout := time.Until(c.deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	return redis.DoWithTimeout(c.Conn, timeout, commandName, args...)
+}
+
+func (b *Backend) poolDo(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 	reply, err = conn.Do(commandName, args...)
 	return reply, err
 }
 
-// GetState retrieves allowance and lastAccessedTimestampNS from a hash set at key
+// GetState is shorthand for GetStateContext(context.Background(), key)
 func (b *Backend) GetState(key string) (allowance int64, lastAccessedTimestampNS int64, err error) {
-	hashSet, err := redis.Int64Map(b.poolDo("HGETALL", key))
-	if err != nil {
-		// non-existent keys represent the first time Allow() is called for a given key and should return
-		// zero values which will be handled properly in beeekind/ratelimit, there is some discussion that we
-		// should instead return a named error that is handled more explicitly one level up the stack so this
-		// behavior may change (!) in future releases
-		if err.Error() == "redigo: nil returned" {
-			return 0, 0, nil
-		}
+	return b.GetStateContext(context.Background(), key)
+}
 
+// GetStateContext implements ratelimit.ContextBackend by retrieving allowance and lastAccessedTimestampNS from a
+// hash set at key. Values that cannot be parsed return an error wrapping ratelimit.ErrCorruptState
+func (b *Backend) GetStateContext(ctx context.Context, key string) (allowance int64, lastAccessedTimestampNS int64, err error) {
+	hashSet, err := redis.StringMap(b.poolDo(ctx, "HGETALL", key))
+	if err != nil {
 		return 0, 0, fmt.Errorf("failed to getState: %w", err)
 	}
 
-	allowance, allowanceExists := hashSet[allowanceKey]
+	// non-existent keys represent the first time Allow() is called for a given key and should return
+	// zero values which will be handled properly in beeekind/ratelimit, there is some discussion that we
+	// should instead return a named error that is handled more explicitly one level up the stack so this
+	// behavior may change (!) in future releases
+	if len(hashSet) == 0 {
+		return 0, 0, nil
+	}
+
+	allowanceStr, allowanceExists := hashSet[allowanceKey]
 	if !allowanceExists {
-		return 0, 0, fmt.Errorf("failed to getState: %s hashSet did not contain key %s", key, allowanceKey)
+		return 0, 0, fmt.Errorf("failed to getState: %w: %s hashSet did not contain key %s", ratelimit.ErrCorruptState, key, allowanceKey)
 	}
 
-	lastAccessedTimestampNS, lastAccessedTimestampNSExists := hashSet[accessedKey]
+	lastAccessedTimestampNSStr, lastAccessedTimestampNSExists := hashSet[accessedKey]
 	if !lastAccessedTimestampNSExists {
-		return 0, 0, fmt.Errorf("failed to getState: %s hashSet did not contain key %s", key, accessedKey)
+		return 0, 0, fmt.Errorf("failed to getState: %w: %s hashSet did not contain key %s", ratelimit.ErrCorruptState, key, accessedKey)
+	}
+
+	allowance, err = strconv.ParseInt(allowanceStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to getState: %w: %v", ratelimit.ErrCorruptState, err)
+	}
+
+	lastAccessedTimestampNS, err = strconv.ParseInt(lastAccessedTimestampNSStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to getState: %w: %v", ratelimit.ErrCorruptState, err)
 	}
 
 	return allowance, lastAccessedTimestampNS, nil
 }
 
-// SetState sets allowance and lastAccessedTimestampNS as a hash set using they keys 0 and 1 to reduce
-// size, respectively
+// SetState is shorthand for SetStateContext(context.Background(), key, allowance, lastAccessedTimestampNS)
 func (b *Backend) SetState(key string, allowance int64, lastAccessedTimestampNS int64) error {
-	if _, err := b.poolDo("HSET", key, allowanceKey, strconv.FormatInt(allowance, 10), accessedKey, strconv.FormatInt(lastAccessedTimestampNS, 10)); err != nil {
+	return b.SetStateContext(context.Background(), key, allowance, lastAccessedTimestampNS)
+}
+
+// SetStateContext implements ratelimit.ContextBackend by setting allowance and lastAccessedTimestampNS as a hash
+// set using they keys 0 and 1 to reduce size, respectively
+func (b *Backend) SetStateContext(ctx context.Context, key string, allowance int64, lastAccessedTimestampNS int64) error {
+	if _, err := b.poolDo(ctx, "HSET", key, allowanceKey, strconv.FormatInt(allowance, 10), accessedKey, strconv.FormatInt(lastAccessedTimestampNS, 10)); err != nil {
 		return fmt.Errorf("failed to setState: %w", err)
 	}
 
 	return nil
 }
 
+// Delete implements ratelimit.Deleter by deleting the hash set at key
+func (b *Backend) Delete(ctx context.Context, key string) error {
+	if _, err := b.poolDo(ctx, "DEL", key); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+
+	return nil
+}
+
+// Take implements ratelimit.AtomicBackend by refilling and spending the hash set at key with a lua script so
+// that concurrent callers sharing the same redis cannot read the same allowance
+func (b *Backend) Take(ctx context.Context, key string, cost, floor, rate, interval, burst, now int64) (allowed bool, allowance int64, lastAccessedTimestampNS int64, err error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("failed to take: %w", err)
+	}
+	defer conn.Close()
+
+	values, err := redis.Values(takeScript.Do(conn, key, cost, rate, interval, burst, now, floor))
+	if err != nil {
+		return false, 0, 0, scriptError("take", err)
+	}
+
+	var allowedInt int64
+	if _, err := redis.Scan(values, &allowedInt, &allowance, &lastAccessedTimestampNS); err != nil {
+		return false, 0, 0, fmt.Errorf("failed to take: %w: %v", ratelimit.ErrCorruptState, err)
+	}
+
+	return allowedInt == 1, allowance, lastAccessedTimestampNS, nil
+}
+
+// TakeAll implements ratelimit.MultiBackend by refilling every hash set in keys and spending from them in a single
+// script, so the keys must hash to the same slot on a redis cluster
+func (b *Backend) TakeAll(ctx context.Context, keys []string, cost int64, limits []ratelimit.Limit, atomic bool, now int64) (allowed []bool, allowances []int64, lastAccessedTimestampsNS []int64, err error) {
+	args := make([]interface{}, 0, 1+len(keys)+3+3*len(limits))
+	args = append(args, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	args = append(args, cost, now, atomic)
+	for _, limit := range limits {
+		args = append(args, limit.Rate, int64(limit.Interval), limit.Burst)
+	}
+
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to takeAll: %w", err)
+	}
+	defer conn.Close()
+
+	values, err := redis.Int64s(takeAllScript.Do(conn, args...))
+	if err != nil {
+		return nil, nil, nil, scriptError("takeAll", err)
+	}
+
+	if len(values) != 3*len(keys) {
+		return nil, nil, nil, fmt.Errorf("failed to takeAll: %w: unexpected reply length %d", ratelimit.ErrCorruptState, len(values))
+	}
+
+	allowed = make([]bool, len(keys))
+	allowances = make([]int64, len(keys))
+	lastAccessedTimestampsNS = make([]int64, len(keys))
+	for i := range keys {
+		allowed[i] = values[3*i] == 1
+		allowances[i] = values[3*i+1]
+		lastAccessedTimestampsNS[i] = values[3*i+2]
+	}
+
+	return allowed, allowances, lastAccessedTimestampsNS, nil
+}
+
+// AcquireLease implements ratelimit.LeaseBackend with a sorted set at key whose members are lease ids scored by
+// their expiry in milliseconds, the precision a redis score can hold
+func (b *Backend) AcquireLease(ctx context.Context, key, id string, limit, expires, now int64) (acquired bool, held int64, err error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to acquireLease: %w", err)
+	}
+	defer conn.Close()
+
+	values, err := redis.Int64s(acquireLeaseScript.Do(conn, key, id, limit, expires/int64(time.Millisecond), now/int64(time.Millisecond)))
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to acquireLease: %w", err)
+	}
+
+	if len(values) != 2 {
+		return false, 0, fmt.Errorf("failed to acquireLease: unexpected reply length %d", len(values))
+	}
+
+	return values[0] == 1, values[1], nil
+}
+
+// ReleaseLease implements ratelimit.LeaseBackend by removing id from the sorted set at key
+func (b *Backend) ReleaseLease(ctx context.Context, key, id string) error {
+	if _, err := b.poolDo(ctx, "ZREM", key, id); err != nil {
+		return fmt.Errorf("failed to releaseLease: %w", err)
+	}
+
+	return nil
+}
+
 // GetStateKey retrieves the allowance and lastAccessedTimestampNS values as a concatenated string instead
 // of a hash set so we can test the performance difference between the two storage mechanisms
 func (b *Backend) GetStateKey(key string) (allowance int64, lastAccessedTimestampNS int64, err error) {
-	s, err := redis.String(b.poolDo("GET", key))
+	s, err := redis.String(b.poolDo(context.Background(), "GET", key))
 	if err != nil {
 		// non-existent keys represent the first time Allow() is called for a given key and should return
 		// zero values which will be handled properly in beeekind/ratelimit, there is some discussion that we
@@ -99,17 +274,17 @@ func (b *Backend) GetStateKey(key string) (allowance int64, lastAccessedTimestam
 
 	parts := strings.Split(s, ":")
 	if len(parts) != 2 {
-		return 0, 0, errors.New("failed to getState: value for key not delimited by colon ':'")
+		return 0, 0, fmt.Errorf("failed to getState: %w: value for key not delimited by colon ':'", ratelimit.ErrCorruptState)
 	}
 
 	allowance, err = strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to getState: value cannot be parsed to int64: %w", err)
+		return 0, 0, fmt.Errorf("failed to getState: %w: value cannot be parsed to int64: %v", ratelimit.ErrCorruptState, err)
 	}
 
 	lastAccessedTimestampNS, err = strconv.ParseInt(parts[1], 10, 64)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to getState: value cannot be parsed to int64: %w", err)
+		return 0, 0, fmt.Errorf("failed to getState: %w: value cannot be parsed to int64: %v", ratelimit.ErrCorruptState, err)
 	}
 
 	return allowance, lastAccessedTimestampNS, nil
@@ -118,16 +293,26 @@ func (b *Backend) GetStateKey(key string) (allowance int64, lastAccessedTimestam
 // SetStateKey stores the allowance and lastAccessedTimestampNS values as a concatenated string instead
 // of a hash set so we can test the performance difference between the two storage mechanisms
 func (b *Backend) SetStateKey(key string, allowance int64, lastAccessedTimestampNS int64) error {
-	if _, err := b.poolDo("SET", key, fmt.Sprintf("%v:%v", strconv.FormatInt(allowance, 10), strconv.FormatInt(lastAccessedTimestampNS, 10))); err != nil {
+	if _, err := b.poolDo(context.Background(), "SET", key, fmt.Sprintf("%v:%v", strconv.FormatInt(allowance, 10), strconv.FormatInt(lastAccessedTimestampNS, 10))); err != nil {
 		return fmt.Errorf("failed to setState: %w", err)
 	}
 
 	return nil
 }
 
+// scriptError wraps an error returned by a lua script, mapping the script.CorruptStateError reply to
+// ratelimit.ErrCorruptState
+func scriptError(op string, err error) error {
+	if strings.HasPrefix(err.Error(), script.CorruptStateError) {
+		return fmt.Errorf("failed to %s: %w: %v", op, ratelimit.ErrCorruptState, err)
+	}
+
+	return fmt.Errorf("failed to %s: %w", op, err)
+}
+
 // FlushAll keys for testing purposes
 func (b *Backend) FlushAll() error {
-	if _, err := b.poolDo("FLUSHALL"); err != nil {
+	if _, err := b.poolDo(context.Background(), "FLUSHALL"); err != nil {
 		return err
 	}
 
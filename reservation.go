@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Reservation holds the tokens taken by RateLimit.Reserve() so they can be given back with Cancel() when the
+// work they were taken for is aborted, for example when validation fails after admission
+type Reservation struct {
+	rl  *RateLimit
+	key string
+	n   int64
+	// ok is true when the n tokens were taken from the bucket, or admitted without them by an allow Rule, in
+	// dry-run mode or by the FailurePolicy
+	ok bool
+	// charged is true when the n tokens were actually taken from the bucket in the backend, only those can be
+	// returned by Cancel(). Tokens FailLocal took from the local backend are not returned
+	charged bool
+	// delay is the time.Duration until n tokens are available when ok is false
+	delay time.Duration
+	// mu protects cancelled so that tokens are returned at most once
+	mu        *sync.Mutex
+	cancelled bool
+}
+
+// Reserve takes n tokens from the bucket at key like AllowN() and returns a Reservation that can return them to
+// the bucket with Reservation.Cancel(). The same errors as AllowN() are returned
+func (rl *RateLimit) Reserve(key string, n int64) (*Reservation, error) {
+	result, err := rl.AllowN(key, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reservation{
+		rl:      rl,
+		key:     key,
+		n:       n,
+		ok:      result.Allowed,
+		charged: result.Allowed && !result.DryRun && result.Rule == nil && !result.Degraded,
+		delay:   result.RetryAfter,
+		mu:      &sync.Mutex{},
+	}, nil
+}
+
+// OK reports whether the reserved tokens were taken from the bucket, it is also true when an allow Rule, dry-run
+// mode or the FailurePolicy admitted the reservation without them
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns time.Duration(0) if the reserved tokens were taken, else the time.Duration until they will be
+// available. It is also time.Duration(0) when the reservation was rejected by a deny Rule, so a caller that is not OK
+// must not retry after Delay() in a loop
+func (r *Reservation) Delay() time.Duration {
+	return r.delay
+}
+
+// Cancel returns the reserved tokens to the bucket through the backend so that other callers, in this process or
+// any other process sharing the backend, can spend them. The bucket is never filled beyond burst.
+//
+// Cancel is a no-op if the tokens were never taken or have already been returned
+func (r *Reservation) Cancel() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.charged || r.cancelled {
+		return nil
+	}
+
+	cfg, err := r.rl.configFor(context.Background(), r.key)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err = cfg.call(ctx, "cancel reservation", func(cfg config) error {
+		_, _, _, err := take(ctx, r.rl.keyLocks, cfg, r.key, -r.n, 0, cfg.clock.Now().UnixNano())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	r.cancelled = true
+	return nil
+}
@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+func TestReservationCancelReturnsTokens(t *testing.T) {
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, memory.New())
+	key := "reserve"
+
+	reservation, err := limiter.Reserve(key, defaultTestBurst)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !reservation.OK() || reservation.Delay() != 0 {
+		t.Logf("Reserve(burst) on a new key returned ok %v delay %v", reservation.OK(), reservation.Delay())
+		t.Fail()
+	}
+
+	if result, _ := limiter.Allow(key); result.Allowed {
+		t.Log("Allow succeeded on an emptied bucket")
+		t.Fail()
+	}
+
+	// cancelling twice must only return the tokens once, and never beyond burst
+	for i := 0; i < 2; i++ {
+		if err := reservation.Cancel(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	allowance, _, err := limiter.backend.GetState(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if allowance != defaultTestBurst {
+		t.Logf("allowance %v != burst %v after Cancel", allowance, defaultTestBurst)
+		t.Fail()
+	}
+}
+
+func TestReservationNotOK(t *testing.T) {
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, memory.New())
+	key := "reserveNotOK"
+
+	if _, err := limiter.AllowN(key, defaultTestBurst); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	reservation, err := limiter.Reserve(key, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if reservation.OK() || reservation.Delay() <= 0 {
+		t.Logf("Reserve on an empty bucket returned ok %v delay %v", reservation.OK(), reservation.Delay())
+		t.Fail()
+	}
+
+	// nothing was taken so nothing may be returned
+	if err := reservation.Cancel(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	allowance, _, err := limiter.backend.GetState(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if allowance != 0 {
+		t.Logf("allowance %v != 0 after cancelling a reservation that was not OK", allowance)
+		t.Fail()
+	}
+}
+
+func TestReservationCancelInvalidConfig(t *testing.T) {
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, memory.New())
+	key := "reserveInvalid"
+
+	reservation, err := limiter.Reserve(key, 1)
+	if err != nil || !reservation.OK() {
+		t.Fatalf("Reserve() returned %+v err %v", reservation, err)
+	}
+
+	// a zero interval must be rejected rather than divided by when refilling the bucket
+	limiter.SetInterval(0)
+	if err := reservation.Cancel(); !errors.Is(err, ErrInvalidConfig) {
+		t.Logf("Cancel() with a zero interval returned err %v", err)
+		t.Fail()
+	}
+
+	// the tokens can still be returned once the config is valid again
+	limiter.SetInterval(defaultTestInterval)
+	if err := reservation.Cancel(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	allowance, _, err := limiter.backend.GetState(key)
+	if err != nil || allowance != defaultTestBurst {
+		t.Logf("allowance %v err %v after Cancel", allowance, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RuleKind is how a Rule matches keys
+type RuleKind int
+
+const (
+	// ExactRule matches the key equal to Rule.Pattern
+	ExactRule RuleKind = iota + 1
+	// PrefixRule matches every key starting with Rule.Pattern
+	PrefixRule
+	// CIDRRule matches every key that is an IP address within the range Rule.Pattern, i.e. "10.0.0.0/8"
+	CIDRRule
+)
+
+// String implements fmt.Stringer
+func (k RuleKind) String() string {
+	switch k {
+	case ExactRule:
+		return "exact"
+	case PrefixRule:
+		return "prefix"
+	case CIDRRule:
+		return "cidr"
+	default:
+		return fmt.Sprintf("RuleKind(%d)", int(k))
+	}
+}
+
+// Rule matches keys that bypass the limit, see RateLimit.SetAllowList() and RateLimit.SetDenyList()
+type Rule struct {
+	Kind    RuleKind
+	Pattern string
+}
+
+// String implements fmt.Stringer, i.e. "prefix:health/"
+func (r Rule) String() string {
+	return r.Kind.String() + ":" + r.Pattern
+}
+
+// ruleList is a compiled set of Rules. It is never mutated once built so that snapshots taken by config() can be
+// read without a lock
+type ruleList struct {
+	exact    map[string]Rule
+	prefixes []Rule
+	networks []*net.IPNet
+	// cidrs holds the Rule of the network at the same index
+	cidrs []Rule
+}
+
+// newRuleList compiles rules, returning an error wrapping ErrInvalidConfig for an unknown kind or an invalid CIDR
+func newRuleList(rules []Rule) (*ruleList, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	list := &ruleList{exact: make(map[string]Rule)}
+	for _, rule := range rules {
+		switch rule.Kind {
+		case ExactRule:
+			list.exact[rule.Pattern] = rule
+		case PrefixRule:
+			list.prefixes = append(list.prefixes, rule)
+		case CIDRRule:
+			_, network, err := net.ParseCIDR(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%w: rule %v: %v", ErrInvalidConfig, rule, err)
+			}
+
+			list.networks = append(list.networks, network)
+			list.cidrs = append(list.cidrs, rule)
+		default:
+			return nil, fmt.Errorf("%w: rule %v has an unknown kind", ErrInvalidConfig, rule)
+		}
+	}
+
+	return list, nil
+}
+
+// match returns the first Rule matching key, exact rules are checked before prefixes and prefixes before CIDRs.
+// A nil ruleList matches nothing
+func (l *ruleList) match(key string) (Rule, bool) {
+	if l == nil {
+		return Rule{}, false
+	}
+
+	if rule, ok := l.exact[key]; ok {
+		return rule, true
+	}
+
+	for _, rule := range l.prefixes {
+		if strings.HasPrefix(key, rule.Pattern) {
+			return rule, true
+		}
+	}
+
+	if len(l.networks) == 0 {
+		return Rule{}, false
+	}
+
+	ip := net.ParseIP(key)
+	if ip == nil {
+		return Rule{}, false
+	}
+
+	for i, network := range l.networks {
+		if network.Contains(ip) {
+			return l.cidrs[i], true
+		}
+	}
+
+	return Rule{}, false
+}
+
+// SetAllowList replaces the rules matching keys that are never limited, using a RWMutex to lock the struct for
+// safe concurrent use. Requests for those keys are admitted without reaching the backend and Result.Rule is the
+// Rule that matched. A key matching both lists is denied. Without rules the allow list is cleared
+func (rl *RateLimit) SetAllowList(rules ...Rule) error {
+	list, err := newRuleList(rules)
+	if err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	rl.allowList = list
+	rl.mu.Unlock()
+	return nil
+}
+
+// SetDenyList replaces the rules matching keys that are always rejected, using a RWMutex to lock the struct for
+// safe concurrent use. Requests for those keys are rejected without reaching the backend and Result.Rule is the
+// Rule that matched. Without rules the deny list is cleared
+func (rl *RateLimit) SetDenyList(rules ...Rule) error {
+	list, err := newRuleList(rules)
+	if err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	rl.denyList = list
+	rl.mu.Unlock()
+	return nil
+}
+
+// matchRules returns the Result for key if it matches the deny list or the allow list of cfg
+func (c config) matchRules(key string) (Result, bool) {
+	if rule, ok := c.denyList.match(key); ok {
+		return c.admit(Result{Allowed: false, Limit: c.burst, Rule: &rule}), true
+	}
+
+	if rule, ok := c.allowList.match(key); ok {
+		return Result{Allowed: true, Limit: c.burst, Remaining: c.burst, Rule: &rule}, true
+	}
+
+	return Result{}, false
+}
@@ -0,0 +1,205 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+func TestRuleListMatch(t *testing.T) {
+	list, err := newRuleList([]Rule{
+		{Kind: ExactRule, Pattern: "healthcheck"},
+		{Kind: PrefixRule, Pattern: "partner:"},
+		{Kind: CIDRRule, Pattern: "10.0.0.0/8"},
+		{Kind: CIDRRule, Pattern: "2001:db8::/32"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"healthcheck", "exact:healthcheck"},
+		{"healthcheck2", ""},
+		{"partner:acme", "prefix:partner:"},
+		{"10.1.2.3", "cidr:10.0.0.0/8"},
+		{"11.1.2.3", ""},
+		{"2001:db8::1", "cidr:2001:db8::/32"},
+		{"benjamin", ""},
+	}
+
+	for _, test := range tests {
+		rule, ok := list.match(test.key)
+		got := ""
+		if ok {
+			got = rule.String()
+		}
+
+		if got != test.want {
+			t.Logf("match(%q) returned %q, wanted %q", test.key, got, test.want)
+			t.Fail()
+		}
+	}
+
+	if _, err := newRuleList([]Rule{{Kind: CIDRRule, Pattern: "10.0.0.0"}}); !errors.Is(err, ErrInvalidConfig) {
+		t.Logf("an invalid CIDR returned err %v", err)
+		t.Fail()
+	}
+
+	if _, err := newRuleList([]Rule{{Pattern: "benjamin"}}); !errors.Is(err, ErrInvalidConfig) {
+		t.Logf("a rule without a kind returned err %v", err)
+		t.Fail()
+	}
+}
+
+func TestAllowDenyList(t *testing.T) {
+	// rules are evaluated before the backend so a failing backend is never reached for matching keys
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, &erroringBackend{errors.New("connection refused")})
+	if err := limiter.SetAllowList(Rule{Kind: CIDRRule, Pattern: "10.0.0.0/8"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := limiter.SetDenyList(Rule{Kind: PrefixRule, Pattern: "abuser:"}, Rule{Kind: ExactRule, Pattern: "10.0.0.66"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	result, err := limiter.AllowN("10.0.0.1", defaultTestBurst)
+	if err != nil || !result.Allowed || result.Rule == nil || result.Rule.String() != "cidr:10.0.0.0/8" {
+		t.Logf("allowed key returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	result, err = limiter.Allow("abuser:benjamin")
+	if err != nil || result.Allowed || result.Rule == nil || result.Rule.Kind != PrefixRule {
+		t.Logf("denied key returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	// the deny list wins over the allow list
+	if result, err = limiter.Allow("10.0.0.66"); err != nil || result.Allowed || result.Rule == nil || result.Rule.Kind != ExactRule {
+		t.Logf("key on both lists returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	if _, err = limiter.Allow("benjamin"); !errors.Is(err, ErrBackendUnavailable) {
+		t.Logf("unmatched key returned err %v", err)
+		t.Fail()
+	}
+
+	if err := limiter.SetAllowList(Rule{Kind: CIDRRule, Pattern: "10.0.0.0/33"}); !errors.Is(err, ErrInvalidConfig) {
+		t.Logf("SetAllowList() with an invalid CIDR returned err %v", err)
+		t.Fail()
+	}
+
+	// the invalid list was not applied
+	if result, err = limiter.Allow("10.0.0.1"); err != nil || !result.Allowed {
+		t.Logf("allowed key after a failed SetAllowList() returned %+v err %v", result, err)
+		t.Fail()
+	}
+
+	if err := limiter.SetAllowList(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err = limiter.Allow("10.0.0.1"); !errors.Is(err, ErrBackendUnavailable) {
+		t.Logf("key after clearing the allow list returned err %v", err)
+		t.Fail()
+	}
+}
+
+func TestAllowAllDenyList(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, _ := newTestLimiter(backend)
+		if err := limiter.SetDenyList(Rule{Kind: ExactRule, Pattern: "rules:abuser"}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// a denied key rejects the whole batch without charging the other keys
+		results, err := limiter.AllowAll([]string{"rules:user", "rules:abuser"})
+		if err != nil || results[0].Allowed || results[0].Remaining != defaultTestBurst || results[1].Allowed || results[1].Rule == nil {
+			t.Logf("(%s) AllowAll() with a denied key returned %+v err %v", name, results, err)
+			t.Fail()
+		}
+
+		results, err = limiter.AllowMulti([]string{"rules:user", "rules:abuser"})
+		if err != nil || !results[0].Allowed || results[0].Remaining != defaultTestBurst-1 || results[1].Allowed {
+			t.Logf("(%s) AllowMulti() with a denied key returned %+v err %v", name, results, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestAllowListReservation(t *testing.T) {
+	for name, backend := range testBackends() {
+		limiter, _ := newTestLimiter(backend)
+		key := "rules:reserve"
+		if err := limiter.SetAllowance(key, 0); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := limiter.SetAllowList(Rule{Kind: ExactRule, Pattern: key}); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		reservation, err := limiter.Reserve(key, 5)
+		if err != nil || !reservation.OK() {
+			t.Fatalf("(%s) Reserve() of an allowed key returned %+v err %v", name, reservation, err)
+		}
+
+		// the allow Rule admitted the reservation without taking tokens so none may be returned
+		if err := reservation.Cancel(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status, err := limiter.Status(key); err != nil || status.Allowance != 0 {
+			t.Logf("(%s) Cancel() of an allowed reservation left %+v err %v", name, status, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestRulesBeforePenaltyAdaptive(t *testing.T) {
+	backend := &flakyBackend{backend: memory.New()}
+	limiter, _ := newTestLimiter(backend)
+	if err := limiter.SetAllowList(Rule{Kind: ExactRule, Pattern: "rules:partner"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := limiter.SetDenyList(Rule{Kind: ExactRule, Pattern: "rules:abuser"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	penalty := NewPenalty(limiter, time.Minute, time.Minute)
+	adaptive := NewAdaptive(limiter, 1, 10)
+	for i := 0; i < 3; i++ {
+		// a deny Rule is not a violation so it never starts a lockout
+		if result, err := penalty.Allow("rules:abuser"); err != nil || result.Allowed || result.Rule == nil || !result.LockedUntil.IsZero() {
+			t.Logf("Penalty.Allow() %d of a denied key returned %+v err %v", i, result, err)
+			t.Fail()
+		}
+
+		if result, err := penalty.Allow("rules:partner"); err != nil || !result.Allowed || result.Rule == nil {
+			t.Logf("Penalty.Allow() %d of an allowed key returned %+v err %v", i, result, err)
+			t.Fail()
+		}
+
+		if result, err := adaptive.Allow("rules:abuser"); err != nil || result.Allowed || result.Rule == nil {
+			t.Logf("Adaptive.Allow() %d of a denied key returned %+v err %v", i, result, err)
+			t.Fail()
+		}
+
+		if result, err := adaptive.Allow("rules:partner"); err != nil || !result.Allowed || result.Rule == nil {
+			t.Logf("Adaptive.Allow() %d of an allowed key returned %+v err %v", i, result, err)
+			t.Fail()
+		}
+	}
+
+	if backend.calls != 0 {
+		t.Logf("keys matching a Rule made %d backend calls", backend.calls)
+		t.Fail()
+	}
+}
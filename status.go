@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Status describes the bucket at a key as of now without spending from it, for example to display remaining
+// quota on a dashboard or in response headers
+type Status struct {
+	// Allowance is the number of tokens available now, after refilling the bucket for the time that has passed
+	Allowance int64
+	// Burst is the maximum number of tokens the bucket can refill to
+	Burst int64
+	// NextRefill is the time.Duration until the bucket is next refilled by RateLimit.rate, zero if the bucket is full
+	NextRefill time.Duration
+	// UntilFull is the time.Duration until the bucket holds Burst tokens, zero if the bucket is full
+	UntilFull time.Duration
+}
+
+// Status returns the state of the bucket at key after a virtual refill. It calls RateLimit.backend.GetState() and
+// refillAllowance() but never RateLimit.backend.SetState(), so checking the status does not consume a token
+func (rl *RateLimit) Status(key string) (Status, error) {
+	return rl.StatusContext(context.Background(), key)
+}
+
+// StatusContext is Status() bounded by ctx, see RateLimit.AllowNContext()
+func (rl *RateLimit) StatusContext(ctx context.Context, key string) (Status, error) {
+	cfg, err := rl.configFor(ctx, key)
+	if err != nil {
+		return Status{}, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Status{}, err
+	}
+
+	var previousAllowance, previousLastAccessedTimestampNS int64
+	err = cfg.call(ctx, "get status", func(cfg config) (err error) {
+		previousAllowance, previousLastAccessedTimestampNS, err = getState(ctx, cfg.backend, key)
+		return err
+	})
+	if err != nil {
+		return Status{}, err
+	}
+
+	currentTime := cfg.clock.Now().UnixNano()
+	allowance, lastAccessedTimestampNS := refillAllowance(
+		currentTime,
+		previousAllowance,
+		previousLastAccessedTimestampNS,
+		cfg.burst,
+		int64(cfg.interval),
+		cfg.rate,
+	)
+
+	status := Status{
+		Allowance: allowance,
+		Burst:     cfg.burst,
+	}
+
+	if allowance < cfg.burst {
+		status.NextRefill = timeUntilAvailable(currentTime, allowance, lastAccessedTimestampNS, allowance+1, cfg.interval, cfg.rate)
+		status.UntilFull = timeUntilAvailable(currentTime, allowance, lastAccessedTimestampNS, cfg.burst, cfg.interval, cfg.rate)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+func TestStatusDoesNotConsume(t *testing.T) {
+	limiter := New(defaultTestRate, defaultTestInterval, defaultTestBurst, memory.New())
+	key := "status"
+
+	// a key that has never been seen reports a full bucket
+	for i := 0; i < 2; i++ {
+		status, err := limiter.Status(key)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if status.Allowance != defaultTestBurst || status.Burst != defaultTestBurst || status.NextRefill != 0 || status.UntilFull != 0 {
+			t.Logf("Status of a new key returned %+v", status)
+			t.Fail()
+		}
+	}
+
+	if _, err := limiter.AllowN(key, 3); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	status, err := limiter.Status(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if status.Allowance != defaultTestBurst-3 {
+		t.Logf("Status.Allowance %v != %v", status.Allowance, defaultTestBurst-3)
+		t.Fail()
+	}
+
+	if status.NextRefill <= 0 || status.NextRefill > defaultTestInterval {
+		t.Logf("Status.NextRefill %v is not within (0, %v]", status.NextRefill, defaultTestInterval)
+		t.Fail()
+	}
+
+	if status.UntilFull <= 2*defaultTestInterval || status.UntilFull > 3*defaultTestInterval {
+		t.Logf("Status.UntilFull %v is not within (%v, %v]", status.UntilFull, 2*defaultTestInterval, 3*defaultTestInterval)
+		t.Fail()
+	}
+}
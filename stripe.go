@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"sync"
+
+	"github.com/beeekind/ratelimit/internal/stripe"
+)
+
+// defaultLockStripes is the number of mutexes a RateLimit spreads its keys across
+const defaultLockStripes = 256
+
+// stripedMutex spreads keys across a fixed number of mutexes so that the same key is always serialized
+// while unrelated keys can usually be locked in parallel
+type stripedMutex []sync.Mutex
+
+func newStripedMutex(stripes int) stripedMutex {
+	return make(stripedMutex, stripes)
+}
+
+// lock returns the mutex responsible for key
+func (s stripedMutex) lock(key string) *sync.Mutex {
+	return &s[stripe.Index(key, len(s))]
+}
+
+// lockAll locks the mutexes responsible for every key in ascending order, so that two callers locking
+// overlapping keys cannot deadlock, and returns a function unlocking them
+func (s stripedMutex) lockAll(keys []string) (unlock func()) {
+	locked := stripe.Indexes(keys, len(s))
+	for _, index := range locked {
+		s[index].Lock()
+	}
+
+	return func() {
+		for _, index := range locked {
+			s[index].Unlock()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Wait blocks until a token is granted for key. It is shorthand for WaitN(ctx, key, 1)
+func (rl *RateLimit) Wait(ctx context.Context, key string) error {
+	return rl.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n tokens are granted for key, replacing the Allow() then time.Sleep() loop.
+//
+// Goroutines waiting on the same key are served in the order they called WaitN(), only the first of them spends
+// from the bucket while the others wait for their turn, so no waiter can starve. ErrQueueFull is returned
+// immediately when RateLimit.maxWaiters goroutines are already waiting on key. Note that Allow() does not queue and
+// may take tokens ahead of the waiters.
+//
+// ctx.Err() is returned if ctx is cancelled while waiting, ErrDenied is returned immediately when key matches a
+// deny Rule, and ErrWaitExceedsDeadline is returned without
+// sleeping when the known wait is longer than the time left before the deadline of ctx. Waits are timed with
+// RateLimit.clock while the deadline of ctx is always compared against the wall clock
+func (rl *RateLimit) WaitN(ctx context.Context, key string, n int64) error {
+	cfg := rl.config()
+	ticket, ok := rl.waiters.enqueue(key, cfg.maxWaiters)
+	if !ok {
+		return fmt.Errorf("failed to waitN: %w (%d waiters)", ErrQueueFull, cfg.maxWaiters)
+	}
+	defer rl.waiters.dequeue(key, ticket)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ticket:
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		result, err := rl.AllowNContext(ctx, key, n)
+		if err != nil {
+			return err
+		}
+
+		if result.Allowed {
+			return nil
+		}
+
+		// a deny Rule has no RetryAfter, waiting for it would spin until ctx is done
+		if result.Rule != nil {
+			return fmt.Errorf("failed to waitN: %w (%s)", ErrDenied, result.Rule)
+		}
+
+		wait := result.RetryAfter
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return fmt.Errorf("failed to waitN: %w (wait %v)", ErrWaitExceedsDeadline, wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rl.config().clock.After(wait):
+		}
+	}
+}
+
+// waitQueues hands out turns to the goroutines waiting on the same key in the order they arrived. Every waiter
+// holds a ticket that receives once it is at the head of the queue of its key
+type waitQueues struct {
+	mu     *sync.Mutex
+	queues map[string][]chan struct{}
+}
+
+// newWaitQueues returns a new instance of waitQueues
+func newWaitQueues() *waitQueues {
+	return &waitQueues{
+		mu:     &sync.Mutex{},
+		queues: make(map[string][]chan struct{}),
+	}
+}
+
+// enqueue appends a ticket to the queue of key, or returns false if max > 0 tickets are already queued
+func (w *waitQueues) enqueue(key string, max int) (chan struct{}, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queue := w.queues[key]
+	if max > 0 && len(queue) >= max {
+		return nil, false
+	}
+
+	ticket := make(chan struct{}, 1)
+	if len(queue) == 0 {
+		ticket <- struct{}{}
+	}
+
+	w.queues[key] = append(queue, ticket)
+	return ticket, true
+}
+
+// dequeue removes ticket from the queue of key, handing the turn to the next ticket if ticket was at the head
+func (w *waitQueues) dequeue(key string, ticket chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queue := w.queues[key]
+	for i := range queue {
+		if queue[i] != ticket {
+			continue
+		}
+
+		queue = append(queue[:i], queue[i+1:]...)
+		if i == 0 && len(queue) > 0 {
+			queue[0] <- struct{}{}
+		}
+
+		break
+	}
+
+	if len(queue) == 0 {
+		delete(w.queues, key)
+		return
+	}
+
+	w.queues[key] = queue
+}
+
+// len returns the number of tickets queued for key
+func (w *waitQueues) len(key string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.queues[key])
+}
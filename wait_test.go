@@ -0,0 +1,196 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/beeekind/ratelimit/memory"
+)
+
+var waitTestInterval = 20 * time.Millisecond
+
+func TestWaitBlocksUntilRefill(t *testing.T) {
+	limiter := New(1, waitTestInterval, 1, memory.New())
+	key := "wait"
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.Wait(context.Background(), key); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// the first token is available immediately, the following two each wait for a refill
+	if elapsed := time.Since(start); elapsed < 2*waitTestInterval {
+		t.Logf("3 waits on a burst of 1 returned after %v", elapsed)
+		t.Fail()
+	}
+}
+
+func TestWaitReturnsContextError(t *testing.T) {
+	limiter := New(1, time.Minute, 1, memory.New())
+	key := "waitCancelled"
+
+	if err := limiter.Wait(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(waitTestInterval)
+		cancel()
+	}()
+
+	if err := limiter.Wait(ctx, key); !errors.Is(err, context.Canceled) {
+		t.Logf("cancelled Wait returned err %v", err)
+		t.Fail()
+	}
+}
+
+func TestWaitFailsFastPastDeadline(t *testing.T) {
+	limiter := New(1, time.Minute, 1, memory.New())
+	key := "waitDeadline"
+
+	if err := limiter.Wait(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := limiter.Wait(ctx, key); !errors.Is(err, ErrWaitExceedsDeadline) {
+		t.Logf("Wait past the deadline returned err %v", err)
+		t.Fail()
+	}
+
+	if elapsed := time.Since(start); elapsed > waitTestInterval {
+		t.Logf("Wait past the deadline slept for %v", elapsed)
+		t.Fail()
+	}
+}
+
+// eventually polls condition until it holds, failing the test after a second
+func eventually(t *testing.T, desc string, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+
+	t.Fatalf("timed out waiting for %s", desc)
+}
+
+func TestWaitIsFIFO(t *testing.T) {
+	limiter, clock := newTestLimiter(memory.New())
+	limiter.SetBurst(1)
+	key := "fifo"
+
+	if err := limiter.Wait(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waiters := 5
+	order := make(chan int, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			if err := limiter.Wait(context.Background(), key); err != nil {
+				t.Log(err.Error())
+				t.Fail()
+			}
+			order <- i
+		}(i)
+
+		// start the next waiter only once this one is queued so the arrival order is known
+		eventually(t, "the waiter to queue", func() bool { return limiter.waiters.len(key) == i+1 })
+	}
+
+	for i := 0; i < waiters; i++ {
+		// only the waiter at the head of the queue sleeps on the clock
+		eventually(t, "the head of the queue to sleep", func() bool { return clock.Waiters() == 1 })
+		clock.Advance(defaultTestInterval)
+
+		if served := <-order; served != i {
+			t.Logf("waiter %v was served in position %v", served, i)
+			t.Fail()
+		}
+	}
+
+	if limiter.waiters.len(key) != 0 {
+		t.Logf("%v waiters left in the queue", limiter.waiters.len(key))
+		t.Fail()
+	}
+}
+
+func TestWaitQueueFull(t *testing.T) {
+	limiter, clock := newTestLimiter(memory.New())
+	limiter.SetBurst(1)
+	limiter.SetMaxWaiters(2)
+	key := "full"
+
+	if err := limiter.Wait(context.Background(), key); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- limiter.Wait(ctx, key)
+		}()
+	}
+
+	eventually(t, "two waiters to queue", func() bool { return limiter.waiters.len(key) == 2 })
+	if err := limiter.Wait(ctx, key); !errors.Is(err, ErrQueueFull) {
+		t.Logf("Wait on a full queue returned err %v", err)
+		t.Fail()
+	}
+
+	// cancelled waiters leave the queue, whether they hold the turn or not
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, context.Canceled) {
+			t.Logf("cancelled waiter returned err %v", err)
+			t.Fail()
+		}
+	}
+
+	if limiter.waiters.len(key) != 0 {
+		t.Logf("%v waiters left in the queue", limiter.waiters.len(key))
+		t.Fail()
+	}
+
+	clock.Advance(defaultTestInterval)
+	if err := limiter.Wait(context.Background(), key); err != nil {
+		t.Logf("Wait after the queue emptied returned err %v", err)
+		t.Fail()
+	}
+}
+
+func TestWaitDenied(t *testing.T) {
+	limiter := New(1, waitTestInterval, 1, memory.New())
+	observer := &recordingObserver{}
+	limiter.AddObserver(observer)
+	if err := limiter.SetDenyList(Rule{Kind: PrefixRule, Pattern: "abuser:"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a deny Rule has no RetryAfter so Wait must fail at once rather than retry until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := limiter.Wait(ctx, "abuser:benjamin")
+	if !errors.Is(err, ErrDenied) || errors.Is(err, ErrWaitExceedsDeadline) {
+		t.Logf("Wait on a denied key returned err %v", err)
+		t.Fail()
+	}
+
+	if len(observer.denies) != 1 {
+		t.Logf("Wait on a denied key made %d requests", len(observer.denies))
+		t.Fail()
+	}
+}